@@ -0,0 +1,289 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/lihram/server/v2/storage/directory"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+)
+
+// AdminPathPrefix is the path that the admin API is served under on the
+// client listener.
+const AdminPathPrefix = "/_p2p/admin/"
+
+// adminTimeout is how long admin requests that touch the network may take.
+const adminTimeout = time.Second * 30
+
+type adminSelf struct {
+	ServerName string   `json:"server_name"`
+	PeerID     string   `json:"peer_id"`
+	Addrs      []string `json:"addrs"`
+	PublicKey  string   `json:"public_key"` // base64 of the libp2p marshalled key
+}
+
+type adminPeer struct {
+	PeerID    string   `json:"peer_id"`
+	Addrs     []string `json:"addrs"`
+	Connected bool     `json:"connected"`
+	Rule      string   `json:"rule,omitempty"` // PeerRuleAllow or PeerRuleDeny
+	LatencyMS int64    `json:"latency_ms,omitempty"`
+}
+
+type adminRoom struct {
+	gomatrixserverlib.PublicRoom
+	Source    string                      `json:"source"`
+	FirstSeen gomatrixserverlib.Timestamp `json:"first_seen_ts"`
+	LastSeen  gomatrixserverlib.Timestamp `json:"last_seen_ts"`
+}
+
+type adminDialRequest struct {
+	Addr string `json:"addr"`
+}
+
+type adminPeerRequest struct {
+	PeerID string `json:"peer_id"`
+}
+
+// adminHandler serves the admin API, which shows what the node is doing and
+// lets it be poked from outside. If an admin token is configured, requests
+// must have it as a bearer token. Otherwise they must come from localhost.
+// Requests from web pages are always refused, so that a page open in a
+// browser on the same device can't use the API.
+func (s *Server) adminHandler(token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(AdminPathPrefix+"self", adminMethod(http.MethodGet, s.adminSelf))
+	mux.HandleFunc(AdminPathPrefix+"peers", adminMethod(http.MethodGet, s.adminPeers))
+	mux.HandleFunc(AdminPathPrefix+"rooms", adminMethod(http.MethodGet, s.adminRooms))
+	mux.HandleFunc(AdminPathPrefix+"dial", adminMethod(http.MethodPost, s.adminDial))
+	mux.HandleFunc(AdminPathPrefix+"disconnect", adminMethod(http.MethodPost, s.adminDisconnect))
+	mux.HandleFunc(AdminPathPrefix+"filter", adminMethod(http.MethodGet, s.adminFilter))
+	mux.HandleFunc(AdminPathPrefix+"allow", adminMethod(http.MethodPost, s.adminPeerRule(PeerRuleAllow)))
+	mux.HandleFunc(AdminPathPrefix+"deny", adminMethod(http.MethodPost, s.adminPeerRule(PeerRuleDeny)))
+	mux.HandleFunc(AdminPathPrefix+"unlist", adminMethod(http.MethodPost, s.adminPeerRule(PeerRuleNone)))
+	mux.HandleFunc(AdminPathPrefix+"refresh", adminMethod(http.MethodPost, s.adminRefresh))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Origin") != "" || !adminAuthorised(r, token) {
+			adminError(w, http.StatusForbidden, "forbidden")
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func adminAuthorised(r *http.Request, token string) bool {
+	if token != "" {
+		given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		return subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// adminMethod only passes on requests with the given method. POST requests
+// must be JSON, which web pages can't send to another origin without asking
+// first.
+func adminMethod(method string, f func(*http.Request) (interface{}, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			adminError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		if method == http.MethodPost {
+			if mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mediaType != "application/json" {
+				adminError(w, http.StatusUnsupportedMediaType, "content type must be application/json")
+				return
+			}
+		}
+		res, err := f(r)
+		if err != nil {
+			adminError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		adminJSON(w, http.StatusOK, res)
+	}
+}
+
+func adminJSON(w http.ResponseWriter, code int, res interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		logrus.WithError(err).Warn("Failed to write admin response")
+	}
+}
+
+func adminError(w http.ResponseWriter, code int, message string) {
+	adminJSON(w, code, map[string]string{"error": message})
+}
+
+func decodeAdminRequest(r *http.Request, req interface{}) error {
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64*1024)).Decode(req); err != nil {
+		return fmt.Errorf("invalid request: %w", err)
+	}
+	return nil
+}
+
+func decodeAdminPeer(r *http.Request) (peer.ID, error) {
+	var req adminPeerRequest
+	if err := decodeAdminRequest(r, &req); err != nil {
+		return "", err
+	}
+	p, err := peer.IDB58Decode(req.PeerID)
+	if err != nil {
+		return "", fmt.Errorf("invalid peer ID: %w", err)
+	}
+	return p, nil
+}
+
+func (s *Server) adminSelf(_ *http.Request) (interface{}, error) {
+	h := s.p2p.LibP2P
+	publicKey, err := crypto.MarshalPublicKey(h.Peerstore().PubKey(h.ID()))
+	if err != nil {
+		return nil, err
+	}
+	res := adminSelf{
+		ServerName: string(s.p2p.Base.Cfg.Matrix.ServerName),
+		PeerID:     h.ID().String(),
+		PublicKey:  base64.StdEncoding.EncodeToString(publicKey),
+		Addrs:      []string{},
+	}
+	for _, addr := range h.Addrs() {
+		res.Addrs = append(res.Addrs, addr.String())
+	}
+	return res, nil
+}
+
+// adminPeers lists every peer in the peerstore, whether or not we are
+// connected to it.
+func (s *Server) adminPeers(_ *http.Request) (interface{}, error) {
+	h := s.p2p.LibP2P
+	res := []adminPeer{}
+	for _, p := range h.Peerstore().Peers() {
+		if p == h.ID() {
+			continue
+		}
+		info := adminPeer{
+			PeerID:    p.String(),
+			Addrs:     []string{},
+			Connected: h.Network().Connectedness(p) == network.Connected,
+			Rule:      s.filter.rule(p),
+			LatencyMS: h.Peerstore().LatencyEWMA(p).Milliseconds(),
+		}
+		for _, addr := range h.Peerstore().Addrs(p) {
+			info.Addrs = append(info.Addrs, addr.String())
+		}
+		res = append(res, info)
+	}
+	return res, nil
+}
+
+func (s *Server) adminRooms(_ *http.Request) (interface{}, error) {
+	db, ok := s.publicRoomsDB.(interface {
+		DiscoveredRooms() []directory.DiscoveredRoom
+	})
+	if !ok {
+		return nil, fmt.Errorf("the public rooms database doesn't discover rooms")
+	}
+	res := []adminRoom{}
+	for _, found := range db.DiscoveredRooms() {
+		res = append(res, adminRoom{
+			PublicRoom: found.Room,
+			Source:     found.Source,
+			FirstSeen:  gomatrixserverlib.AsTimestamp(found.FirstSeen),
+			LastSeen:   gomatrixserverlib.AsTimestamp(found.LastSeen),
+		})
+	}
+	return res, nil
+}
+
+func (s *Server) adminDial(r *http.Request) (interface{}, error) {
+	var req adminDialRequest
+	if err := decodeAdminRequest(r, &req); err != nil {
+		return nil, err
+	}
+	infos, err := parsePeerAddrs([]string{req.Addr})
+	if err != nil {
+		return nil, fmt.Errorf("invalid address: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), adminTimeout)
+	defer cancel()
+	for _, info := range infos {
+		if err = s.p2p.LibP2P.Connect(ctx, info); err != nil {
+			return nil, fmt.Errorf("failed to dial %s: %w", info.ID, err)
+		}
+	}
+	return struct{}{}, nil
+}
+
+func (s *Server) adminDisconnect(r *http.Request) (interface{}, error) {
+	p, err := decodeAdminPeer(r)
+	if err != nil {
+		return nil, err
+	}
+	return struct{}{}, s.p2p.LibP2P.Network().ClosePeer(p)
+}
+
+// adminFilter lists the rules of the peer filter, by peer ID.
+func (s *Server) adminFilter(_ *http.Request) (interface{}, error) {
+	res := map[string]string{}
+	for p, rule := range s.filter.rulesByPeer() {
+		res[p.String()] = rule
+	}
+	return res, nil
+}
+
+func (s *Server) adminPeerRule(rule string) func(*http.Request) (interface{}, error) {
+	return func(r *http.Request) (interface{}, error) {
+		var req adminPeerRequest
+		if err := decodeAdminRequest(r, &req); err != nil {
+			return nil, err
+		}
+		return struct{}{}, s.setPeerRule(req.PeerID, rule)
+	}
+}
+
+// adminRefresh refreshes the DHT routing table, and then advertises and looks
+// for public rooms straight away rather than waiting for the next interval.
+func (s *Server) adminRefresh(r *http.Request) (interface{}, error) {
+	ctx, cancel := context.WithTimeout(r.Context(), adminTimeout)
+	defer cancel()
+	if err := s.p2p.LibP2PDHT.Bootstrap(ctx); err != nil {
+		return nil, fmt.Errorf("failed to refresh DHT: %w", err)
+	}
+	if db, ok := s.publicRoomsDB.(interface{ MaintenanceTimer() }); ok {
+		db.MaintenanceTimer()
+	}
+	return struct{}{}, nil
+}
@@ -0,0 +1,317 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"github.com/matrix-org/dendrite/common/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// The public room directory backends that can be chosen in the Config.
+const (
+	PublicRoomsBackendPubSub = "pubsub"
+	PublicRoomsBackendDHT    = "dht"
+)
+
+// The pubsub routers that can be chosen in the Config.
+const (
+	PubSubRouterFloodSub  = "floodsub"
+	PubSubRouterGossipSub = "gossipsub"
+	PubSubRouterRandomSub = "randomsub"
+)
+
+// Config describes how a Dendrite P2P instance is set up. Use NewConfig to
+// get a Config with the defaults filled in. The fields which aren't supported
+// by gomobile can be set with the Add* methods instead.
+type Config struct {
+	// The directory in which the databases and the private key are stored.
+	// It must be set.
+	Path string `yaml:"path"`
+	// The passphrase that the private key file is encrypted with. If empty,
+	// the key file isn't encrypted.
+	KeyPassphrase string `yaml:"key_passphrase"`
+	// The name of this instance, used to name the databases and the key.
+	InstanceName string `yaml:"instance_name"`
+
+	// A human-friendly label for the server name of this instance, e.g.
+	// alice-phone. The server name is the label followed by a tag derived
+	// from our peer ID and NameSuffix, e.g. alice-phone-ab3dxk7pq2mz.p2p, so
+	// that nobody else can claim it. If empty, the server name is our peer
+	// ID. Names are published in the DHT and on pubsub.
+	ServerName string `yaml:"server_name"`
+
+	// The TCP address that the client API listens on, e.g. ":8008". If the
+	// port is 0 then a free port is picked and passed to Callback.SetPort.
+	ListenAddress string `yaml:"listen_address"`
+	// The multiaddrs that libp2p listens on. If empty, libp2p listens on all
+	// interfaces on a random port.
+	LibP2PListenAddresses []string `yaml:"libp2p_listen_addresses"`
+
+	// The data sources of the databases. Any that are left empty will be
+	// SQLite databases in Path, named after the instance.
+	AccountDatabase          string `yaml:"account_database"`
+	DeviceDatabase           string `yaml:"device_database"`
+	MediaAPIDatabase         string `yaml:"media_api_database"`
+	SyncAPIDatabase          string `yaml:"sync_api_database"`
+	RoomServerDatabase       string `yaml:"room_server_database"`
+	ServerKeyDatabase        string `yaml:"server_key_database"`
+	FederationSenderDatabase string `yaml:"federation_sender_database"`
+	AppServiceDatabase       string `yaml:"app_service_database"`
+	PublicRoomsAPIDatabase   string `yaml:"public_rooms_api_database"`
+	NaffkaDatabase           string `yaml:"naffka_database"`
+	// The public rooms that were discovered from other nodes are kept apart
+	// from Dendrite's public rooms database, so that SQLite connections
+	// don't fight over locks.
+	DiscoveredRoomsDatabase string `yaml:"discovered_rooms_database"`
+
+	// Whether to remember the peers that we have been connected to, so that
+	// we can reconnect to them when we restart, and for how many hours to
+	// remember them after we were last connected. The peerstore is always a
+	// SQLite database, in Path unless PeerstoreDatabase is set.
+	PeerstoreEnabled  bool   `yaml:"peerstore_enabled"`
+	PeerstoreExpiry   int    `yaml:"peerstore_expiry"`
+	PeerstoreDatabase string `yaml:"peerstore_database"`
+
+	// Whether to discover peers on the local network with mDNS, how often to
+	// look for them in seconds, and the service tag to advertise.
+	MDNSEnabled    bool   `yaml:"mdns_enabled"`
+	MDNSInterval   int    `yaml:"mdns_interval"`
+	MDNSServiceTag string `yaml:"mdns_service_tag"`
+
+	// Multiaddrs, including the peer ID, of peers that we should always try
+	// to stay connected to.
+	StaticPeers []string `yaml:"static_peers"`
+	// Multiaddrs, including the peer ID, of peers that we connect to at
+	// startup to join the DHT.
+	BootstrapPeers []string `yaml:"bootstrap_peers"`
+	// Whether to advertise ourselves in the DHT under the rendezvous
+	// namespace, and find the other nodes that do the same. This lets us
+	// find nodes outside of the local network.
+	RendezvousEnabled   bool   `yaml:"rendezvous_enabled"`
+	RendezvousNamespace string `yaml:"rendezvous_namespace"`
+
+	// How public rooms are shared with other nodes, either
+	// PublicRoomsBackendPubSub or PublicRoomsBackendDHT.
+	PublicRoomsBackend string `yaml:"public_rooms_backend"`
+	// How many seconds to keep a public room that was announced by another
+	// node after we last heard about it.
+	DiscoveredRoomTTL int `yaml:"discovered_room_ttl"`
+	// How pubsub messages are passed between nodes, either
+	// PubSubRouterGossipSub, PubSubRouterFloodSub or PubSubRouterRandomSub.
+	PubSubRouter string `yaml:"pubsub_router"`
+
+	// Federation requests for homeservers with DNS names are sent directly
+	// over HTTPS, unless a gateway peer is set, in which case they are sent
+	// to it over libp2p and it sends them on. FederationGatewayEnabled makes
+	// us act as a gateway for other nodes.
+	FederationGatewayPeer    string `yaml:"federation_gateway_peer"`
+	FederationGatewayEnabled bool   `yaml:"federation_gateway_enabled"`
+
+	// Whether to only talk to nodes that share a pre-shared key, and the key
+	// as 64 hex digits. If the key is empty, it is read from swarm.key in
+	// Path. Nodes in a private network use their own mDNS service tag, DHT
+	// protocol and pubsub topics, so they never mix with other networks.
+	PrivateNetwork    bool   `yaml:"private_network"`
+	PrivateNetworkKey string `yaml:"private_network_key"`
+
+	// Whether we can connect to other peers through relays, whether we look
+	// for relays to advertise when we're behind NAT, and whether we act as a
+	// relay for other peers.
+	RelayEnabled bool `yaml:"relay_enabled"`
+	AutoRelay    bool `yaml:"auto_relay"`
+	RelayHop     bool `yaml:"relay_hop"`
+
+	// Whether to only accept peers that have been allowed with
+	// Server.AllowPeer or the admin API, e.g. on shared networks. Bootstrap,
+	// static and relay peers must be allowed too. The peer filter is always a
+	// SQLite database, in Path unless PeerFilterDatabase is set.
+	AllowlistOnly      bool   `yaml:"allowlist_only"`
+	PeerFilterDatabase string `yaml:"peer_filter_database"`
+
+	// The token that must be given as a bearer token to use the admin API
+	// under /_p2p/admin/. If empty, the admin API can only be used from
+	// localhost.
+	AdminToken string `yaml:"admin_token"`
+
+	// The perspective servers that we trust to tell us about the keys of
+	// other servers.
+	KeyPerspectives config.KeyPerspectives `yaml:"key_perspectives"`
+}
+
+// NewConfig returns a Config for an instance with the given name, storing
+// its databases in the given path, with all other settings at their defaults.
+func NewConfig(path string, instanceName string) *Config {
+	return &Config{
+		Path:                path,
+		InstanceName:        instanceName,
+		ListenAddress:       ":0",
+		PeerstoreEnabled:    true,
+		PeerstoreExpiry:     24 * 7,
+		MDNSEnabled:         true,
+		MDNSInterval:        10,
+		MDNSServiceTag:      "_matrix-dendrite-p2p._tcp",
+		RendezvousEnabled:   true,
+		RendezvousNamespace: "/matrix/dendrite-p2p",
+		PublicRoomsBackend:  PublicRoomsBackendPubSub,
+		DiscoveredRoomTTL:   60 * 60,
+		PubSubRouter:        PubSubRouterGossipSub,
+		RelayEnabled:        true,
+		AutoRelay:           true,
+		RelayHop:            true,
+	}
+}
+
+// NewLoopbackConfig returns a Config for an instance that only listens on
+// localhost and doesn't look for peers by itself, so that several instances
+// can run side by side in one process, e.g. in tests. Connect them to each
+// other with Server.Connect.
+func NewLoopbackConfig(path string, instanceName string) *Config {
+	c := NewConfig(path, instanceName)
+	c.ListenAddress = "127.0.0.1:0"
+	c.LibP2PListenAddresses = []string{"/ip4/127.0.0.1/tcp/0"}
+	c.PeerstoreEnabled = false
+	c.MDNSEnabled = false
+	c.RendezvousEnabled = false
+	c.RelayEnabled = false
+	c.AutoRelay = false
+	c.RelayHop = false
+	return c
+}
+
+// LoadConfig reads a Config from a YAML or JSON file. Anything not set in the
+// file is left at the defaults from NewConfig.
+func LoadConfig(filename string) (*Config, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	cfg := NewConfig("", "")
+	if err = yaml.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse config file '%s': %w", filename, err)
+	}
+	return cfg, nil
+}
+
+// AddLibP2PListenAddress adds a multiaddr for libp2p to listen on.
+func (c *Config) AddLibP2PListenAddress(addr string) {
+	c.LibP2PListenAddresses = append(c.LibP2PListenAddresses, addr)
+}
+
+// AddStaticPeer adds the multiaddr of a peer that we should always try to stay
+// connected to.
+func (c *Config) AddStaticPeer(addr string) {
+	c.StaticPeers = append(c.StaticPeers, addr)
+}
+
+// AddBootstrapPeer adds the multiaddr of a peer that we connect to at startup.
+func (c *Config) AddBootstrapPeer(addr string) {
+	c.BootstrapPeers = append(c.BootstrapPeers, addr)
+}
+
+// AddKeyPerspective adds a trusted key of a perspective server. It can be
+// called more than once for the same server to trust several of its keys.
+func (c *Config) AddKeyPerspective(serverName string, keyID string, publicKey string) {
+	key := config.KeyPerspectiveTrustKey{
+		KeyID:     gomatrixserverlib.KeyID(keyID),
+		PublicKey: publicKey,
+	}
+	for i := range c.KeyPerspectives {
+		if c.KeyPerspectives[i].ServerName == gomatrixserverlib.ServerName(serverName) {
+			c.KeyPerspectives[i].Keys = append(c.KeyPerspectives[i].Keys, key)
+			return
+		}
+	}
+	c.KeyPerspectives = append(c.KeyPerspectives, config.KeyPerspective{
+		ServerName: gomatrixserverlib.ServerName(serverName),
+		Keys:       []config.KeyPerspectiveTrustKey{key},
+	})
+}
+
+func (c *Config) verify() error {
+	if c.Path == "" {
+		return fmt.Errorf("no path configured")
+	}
+	if c.InstanceName == "" {
+		return fmt.Errorf("no instance name configured")
+	}
+	if c.ServerName != "" {
+		if err := validNameLabel(c.ServerName); err != nil {
+			return err
+		}
+	}
+	switch c.PublicRoomsBackend {
+	case PublicRoomsBackendPubSub, PublicRoomsBackendDHT:
+	default:
+		return fmt.Errorf("unknown public rooms backend %q", c.PublicRoomsBackend)
+	}
+	switch c.PubSubRouter {
+	case PubSubRouterFloodSub, PubSubRouterGossipSub, PubSubRouterRandomSub:
+	default:
+		return fmt.Errorf("unknown pubsub router %q", c.PubSubRouter)
+	}
+	if c.DiscoveredRoomTTL <= 0 {
+		return fmt.Errorf("discovered room TTL must be positive")
+	}
+	if c.PeerstoreEnabled && c.PeerstoreExpiry <= 0 {
+		return fmt.Errorf("peerstore expiry must be positive")
+	}
+	if c.MDNSEnabled && c.MDNSInterval <= 0 {
+		return fmt.Errorf("mDNS interval must be positive")
+	}
+	if c.RendezvousEnabled && c.RendezvousNamespace == "" {
+		return fmt.Errorf("no rendezvous namespace configured")
+	}
+	return nil
+}
+
+// dataSource returns the configured data source, or a SQLite database in
+// Path named after the instance if none was configured.
+func (c *Config) dataSource(configured string, name string) config.DataSource {
+	if configured != "" {
+		return config.DataSource(configured)
+	}
+	return config.DataSource(fmt.Sprintf("file:%s/%s-%s.db", c.Path, c.InstanceName, name))
+}
+
+// dendriteConfig builds the configuration for the Dendrite components.
+func (c *Config) dendriteConfig(key signingKey) (*config.Dendrite, error) {
+	cfg := config.Dendrite{}
+	cfg.Matrix.PrivateKey = key.PrivateKey
+	cfg.Matrix.KeyID = key.KeyID
+	cfg.Matrix.KeyPerspectives = c.KeyPerspectives
+	cfg.Kafka.UseNaffka = true
+	cfg.Kafka.Topics.OutputRoomEvent = "roomserverOutput"
+	cfg.Kafka.Topics.OutputClientData = "clientapiOutput"
+	cfg.Kafka.Topics.OutputTypingEvent = "typingServerOutput"
+	cfg.Kafka.Topics.UserUpdates = "userUpdates"
+	cfg.Database.Account = c.dataSource(c.AccountDatabase, "account")
+	cfg.Database.Device = c.dataSource(c.DeviceDatabase, "device")
+	cfg.Database.MediaAPI = c.dataSource(c.MediaAPIDatabase, "mediaapi")
+	cfg.Database.SyncAPI = c.dataSource(c.SyncAPIDatabase, "syncapi")
+	cfg.Database.RoomServer = c.dataSource(c.RoomServerDatabase, "roomserver")
+	cfg.Database.ServerKey = c.dataSource(c.ServerKeyDatabase, "serverkey")
+	cfg.Database.FederationSender = c.dataSource(c.FederationSenderDatabase, "federationsender")
+	cfg.Database.AppService = c.dataSource(c.AppServiceDatabase, "appservice")
+	cfg.Database.PublicRoomsAPI = c.dataSource(c.PublicRoomsAPIDatabase, "publicroomsa")
+	cfg.Database.Naffka = c.dataSource(c.NaffkaDatabase, "naffka")
+	if err := cfg.Derive(); err != nil {
+		return nil, fmt.Errorf("failed to derive config: %w", err)
+	}
+	return &cfg, nil
+}
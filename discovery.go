@@ -0,0 +1,255 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	discovery "github.com/libp2p/go-libp2p-discovery"
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	p2pdisc "github.com/libp2p/go-libp2p/p2p/discovery"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+// StaticPeerInterval is how often we try to reconnect to static peers that we
+// aren't connected to.
+const StaticPeerInterval = time.Second * 30
+
+// peerDialTimeout is how long we try to connect to a discovered peer for.
+const peerDialTimeout = time.Second * 30
+
+// RendezvousInterval is how often we look for other nodes advertising
+// themselves in the DHT.
+const RendezvousInterval = time.Minute
+
+// peerDiscovery is a way of finding peers. Each one runs in the background
+// until the context is cancelled, passing the peers it finds to the notifee.
+type peerDiscovery interface {
+	start(ctx context.Context, notifee *peerNotifee) error
+}
+
+// peerNotifee connects to the peers that any of the discovery backends find.
+// Their keys are then stored by the keyExchange.
+type peerNotifee struct {
+	ctx        context.Context // the libp2p context, so that we stop dialing when the host stops
+	host       host.Host
+	filter     *peerFilter
+	discovered *prometheus.CounterVec // counts the new peers found, by source
+	source     string
+}
+
+// withSource returns a notifee which logs the given discovery source.
+func (n *peerNotifee) withSource(source string) *peerNotifee {
+	return &peerNotifee{
+		ctx:        n.ctx,
+		host:       n.host,
+		filter:     n.filter,
+		discovered: n.discovered,
+		source:     source,
+	}
+}
+
+// HandlePeerFound implements p2pdisc.Notifee, so that the notifee can be
+// passed to the mDNS service directly.
+func (n *peerNotifee) HandlePeerFound(p peer.AddrInfo) {
+	if n.ctx.Err() != nil || p.ID == n.host.ID() || !n.filter.accepts(p.ID) {
+		return
+	}
+	// mDNS and static peers report the same peers over and over, so only
+	// count the ones that we aren't connected to yet.
+	if n.host.Network().Connectedness(p.ID) == network.Connected {
+		return
+	}
+	n.discovered.WithLabelValues(n.source).Inc()
+	ctx, cancel := context.WithTimeout(n.ctx, peerDialTimeout)
+	defer cancel()
+	if err := n.host.Connect(ctx, p); err != nil {
+		fmt.Println("Error adding peer", p.ID.String(), "via", n.source+":", err)
+		return
+	}
+	fmt.Println("Connected to peer", p.ID.String(), "via", n.source)
+}
+
+// startDiscovery starts all of the discovery backends that are enabled in the
+// config, as well as any others that are given. The peers that they find are
+// counted in discovered.
+func startDiscovery(p2p *p2pDendrite, p2pCfg *Config, filter *peerFilter, discovered *prometheus.CounterVec, backends ...peerDiscovery) error {
+	if len(p2pCfg.BootstrapPeers) > 0 {
+		peers, err := parsePeerAddrs(p2pCfg.BootstrapPeers)
+		if err != nil {
+			return fmt.Errorf("invalid bootstrap peer: %w", err)
+		}
+		backends = append(backends, &bootstrapDiscovery{peers: peers, dht: p2p.LibP2PDHT})
+	}
+	if len(p2pCfg.StaticPeers) > 0 {
+		peers, err := parsePeerAddrs(p2pCfg.StaticPeers)
+		if err != nil {
+			return fmt.Errorf("invalid static peer: %w", err)
+		}
+		backends = append(backends, &staticDiscovery{peers: peers})
+	}
+	if p2pCfg.MDNSEnabled {
+		serviceTag := p2pCfg.MDNSServiceTag
+		if ns := p2p.LibP2PNamespace; ns != "" {
+			// The namespace goes into the service name, before the protocol.
+			if i := strings.Index(serviceTag, "._"); i >= 0 {
+				serviceTag = serviceTag[:i] + "-" + ns + serviceTag[i:]
+			} else {
+				serviceTag += "-" + ns
+			}
+		}
+		backends = append(backends, &mdnsDiscovery{
+			interval:   time.Second * time.Duration(p2pCfg.MDNSInterval),
+			serviceTag: serviceTag,
+		})
+	}
+	if p2pCfg.RendezvousEnabled {
+		backends = append(backends, &rendezvousDiscovery{
+			dht:       p2p.LibP2PDHT,
+			namespace: p2pCfg.RendezvousNamespace,
+		})
+	}
+
+	notifee := &peerNotifee{
+		ctx:        p2p.LibP2PContext,
+		host:       p2p.LibP2P,
+		filter:     filter,
+		discovered: discovered,
+	}
+	for _, backend := range backends {
+		if err := backend.start(p2p.LibP2PContext, notifee); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parsePeerAddrs parses multiaddrs which include the peer ID, e.g.
+// /ip4/1.2.3.4/tcp/4001/p2p/QmPeer, grouping the addresses by peer.
+func parsePeerAddrs(addrs []string) ([]peer.AddrInfo, error) {
+	var maddrs []ma.Multiaddr
+	for _, addr := range addrs {
+		maddr, err := ma.NewMultiaddr(addr)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %w", addr, err)
+		}
+		maddrs = append(maddrs, maddr)
+	}
+	return peer.AddrInfosFromP2pAddrs(maddrs...)
+}
+
+// mdnsDiscovery finds peers on the local network.
+type mdnsDiscovery struct {
+	interval   time.Duration
+	serviceTag string
+}
+
+func (d *mdnsDiscovery) start(ctx context.Context, notifee *peerNotifee) error {
+	serv, err := p2pdisc.NewMdnsService(ctx, notifee.host, d.interval, d.serviceTag)
+	if err != nil {
+		return fmt.Errorf("failed to start mDNS: %w", err)
+	}
+	serv.RegisterNotifee(notifee.withSource("mDNS"))
+	go func() {
+		<-ctx.Done()
+		serv.Close() // nolint: errcheck
+	}()
+	return nil
+}
+
+// staticDiscovery keeps us connected to a fixed list of peers.
+type staticDiscovery struct {
+	peers []peer.AddrInfo
+}
+
+func (d *staticDiscovery) start(ctx context.Context, notifee *peerNotifee) error {
+	notifee = notifee.withSource("static peers")
+	go func() {
+		ticker := time.NewTicker(StaticPeerInterval)
+		defer ticker.Stop()
+		for {
+			for _, p := range d.peers {
+				notifee.HandlePeerFound(p)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return nil
+}
+
+// bootstrapDiscovery connects to a list of well-known peers at startup and
+// uses them to join the DHT.
+type bootstrapDiscovery struct {
+	peers []peer.AddrInfo
+	dht   *dht.IpfsDHT
+}
+
+func (d *bootstrapDiscovery) start(ctx context.Context, notifee *peerNotifee) error {
+	notifee = notifee.withSource("bootstrap peers")
+	go func() {
+		for _, p := range d.peers {
+			notifee.HandlePeerFound(p)
+		}
+		if err := d.dht.Bootstrap(ctx); err != nil {
+			logrus.WithError(err).Warn("Failed to bootstrap the DHT")
+		}
+	}()
+	return nil
+}
+
+// rendezvousDiscovery advertises us in the DHT under a namespace, and finds
+// the other nodes that advertise under the same namespace.
+type rendezvousDiscovery struct {
+	dht       *dht.IpfsDHT
+	namespace string
+}
+
+func (d *rendezvousDiscovery) start(ctx context.Context, notifee *peerNotifee) error {
+	notifee = notifee.withSource("DHT rendezvous")
+	routingDiscovery := discovery.NewRoutingDiscovery(d.dht)
+	discovery.Advertise(ctx, routingDiscovery, d.namespace)
+	go func() {
+		ticker := time.NewTicker(RendezvousInterval)
+		defer ticker.Stop()
+		for {
+			peers, err := routingDiscovery.FindPeers(ctx, d.namespace)
+			if err != nil {
+				logrus.WithError(err).Warn("Failed to find peers in the DHT")
+			} else {
+				for p := range peers {
+					notifee.HandlePeerFound(p)
+				}
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return nil
+}
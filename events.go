@@ -0,0 +1,199 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/sirupsen/logrus"
+)
+
+// EventInterval is how often we check for changes to our listen addresses
+// and the number of public rooms.
+const EventInterval = time.Second * 10
+
+// EventCallback can optionally be implemented by a Callback to be told about
+// the state of the node, e.g. to show live network status in the UI. All of
+// the types used are supported by gomobile. The methods are called one at a
+// time, in order, from a goroutine of their own, so they may block or call
+// back into the Server.
+type EventCallback interface {
+	// OnReady is called once the APIs are being served.
+	OnReady()
+	// OnPeerDiscovered is called when we connect to a libp2p peer.
+	OnPeerDiscovered(peerID string)
+	// OnPeerLost is called when we are no longer connected to a peer.
+	OnPeerLost(peerID string)
+	// OnListenAddrsChanged is called with our libp2p addresses, separated by
+	// newlines, whenever they change.
+	OnListenAddrsChanged(addrs string)
+	// OnPublicRoomCountChanged is called when the number of public rooms that
+	// we know about changes.
+	OnPublicRoomCountChanged(count int)
+	// OnError is called when something goes wrong after startup.
+	OnError(message string)
+}
+
+// eventNotifier passes node events on to an EventCallback. It keeps track of
+// what it last told the callback so that it only reports changes. Events are
+// queued and passed on by run, so that the callback is never called with the
+// mutex held or from a libp2p goroutine.
+type eventNotifier struct {
+	callback  EventCallback         // nil if the callback doesn't want events
+	peers     map[peer.ID]bool      // peers that we have reported as discovered
+	addrs     string                // last reported listen addresses
+	roomCount int                   // last reported public room count
+	queue     []func(EventCallback) // events that haven't been passed on yet
+	mutex     sync.Mutex            // protects the above
+	wake      chan struct{}         // signals run that there are queued events
+	notifiee  network.NotifyBundle  //
+}
+
+func newEventNotifier(callback Callback) *eventNotifier {
+	n := &eventNotifier{
+		peers:     make(map[peer.ID]bool),
+		roomCount: -1,
+		wake:      make(chan struct{}, 1),
+	}
+	n.callback, _ = callback.(EventCallback)
+	n.notifiee = network.NotifyBundle{
+		ConnectedF: func(_ network.Network, c network.Conn) {
+			n.peerFound(c.RemotePeer())
+		},
+		DisconnectedF: func(net network.Network, c network.Conn) {
+			if net.Connectedness(c.RemotePeer()) != network.Connected {
+				n.peerLost(c.RemotePeer())
+			}
+		},
+	}
+	return n
+}
+
+// run passes queued events on to the callback until the context is
+// cancelled.
+func (n *eventNotifier) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-n.wake:
+		}
+		n.mutex.Lock()
+		queue := n.queue
+		n.queue = nil
+		n.mutex.Unlock()
+		for _, event := range queue {
+			event(n.callback)
+		}
+	}
+}
+
+// emit queues an event for the callback. The mutex must be held, so that
+// events are queued in the same order as the changes they report.
+func (n *eventNotifier) emit(event func(EventCallback)) {
+	if n.callback == nil {
+		return
+	}
+	n.queue = append(n.queue, event)
+	select {
+	case n.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (n *eventNotifier) ready() {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.emit(func(cb EventCallback) { cb.OnReady() })
+}
+
+func (n *eventNotifier) peerFound(p peer.ID) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if n.peers[p] {
+		return
+	}
+	n.peers[p] = true
+	n.emit(func(cb EventCallback) { cb.OnPeerDiscovered(p.String()) })
+}
+
+func (n *eventNotifier) peerLost(p peer.ID) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if !n.peers[p] {
+		return
+	}
+	delete(n.peers, p)
+	n.emit(func(cb EventCallback) { cb.OnPeerLost(p.String()) })
+}
+
+// monitor periodically checks for changes to our listen addresses and the
+// number of public rooms until the libp2p context is cancelled.
+func (s *Server) monitor() {
+	ticker := time.NewTicker(EventInterval)
+	defer ticker.Stop()
+	for {
+		s.checkListenAddrs()
+		s.checkPublicRoomCount()
+		select {
+		case <-s.p2p.LibP2PContext.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *Server) checkListenAddrs() {
+	var addrs []string
+	for _, addr := range s.p2p.LibP2P.Addrs() {
+		addrs = append(addrs, addr.String())
+	}
+	sort.Strings(addrs)
+	joined := strings.Join(addrs, "\n")
+
+	n := s.events
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if joined == n.addrs {
+		return
+	}
+	n.addrs = joined
+	n.emit(func(cb EventCallback) { cb.OnListenAddrsChanged(joined) })
+}
+
+func (s *Server) checkPublicRoomCount() {
+	ctx, cancel := context.WithTimeout(s.p2p.LibP2PContext, 3*time.Second)
+	defer cancel()
+	count, err := s.publicRoomsDB.CountPublicRooms(ctx)
+	if err != nil {
+		logrus.WithError(err).Warn("Failed to count public rooms")
+		return
+	}
+
+	n := s.events
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if int(count) == n.roomCount {
+		return
+	}
+	n.roomCount = int(count)
+	n.emit(func(cb EventCallback) { cb.OnPublicRoomCountChanged(int(count)) })
+}
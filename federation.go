@@ -0,0 +1,183 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// isP2PServerName returns whether the server name belongs to a libp2p node,
+// either because it is a peer ID or a human-friendly name.
+func isP2PServerName(serverName string) bool {
+	if strings.HasSuffix(serverName, NameSuffix) {
+		return true
+	}
+	_, err := peer.IDB58Decode(serverName)
+	return err == nil
+}
+
+// routingTransport sends federation requests for libp2p nodes over libp2p,
+// and requests for other homeservers over HTTPS, either directly or through a
+// gateway peer which sends them on for us.
+type routingTransport struct {
+	p2p     http.RoundTripper // for matrix:// URLs whose host is a peer ID or name
+	https   http.RoundTripper // for matrix:// URLs whose host is a DNS name
+	gateway peer.ID           // sends requests to DNS names through this peer, if set
+}
+
+func (t *routingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	switch {
+	case isP2PServerName(req.URL.Hostname()):
+		return t.p2p.RoundTrip(req)
+	case t.gateway != "":
+		// The Host header keeps the real destination, so that the gateway
+		// knows where to send the request.
+		viaGateway := req.Clone(req.Context())
+		viaGateway.URL.Host = t.gateway.String()
+		viaGateway.Host = req.URL.Host
+		return t.p2p.RoundTrip(viaGateway)
+	default:
+		return t.https.RoundTrip(req)
+	}
+}
+
+// resolveCacheTTL is how long we remember where a homeserver was found, so
+// that .well-known and SRV lookups aren't repeated for every request.
+const resolveCacheTTL = time.Hour
+
+type resolvedServer struct {
+	results []gomatrixserverlib.ResolutionResult
+	expires time.Time
+}
+
+// httpsTransport sends matrix:// requests to normal homeservers, using Matrix
+// server discovery to find where to send them.
+type httpsTransport struct {
+	transports map[string]*http.Transport                      // by TLS server name
+	resolved   map[gomatrixserverlib.ServerName]resolvedServer // by server name
+	mutex      sync.Mutex                                      // protects the above
+}
+
+func newHTTPSTransport() *httpsTransport {
+	return &httpsTransport{
+		transports: make(map[string]*http.Transport),
+		resolved:   make(map[gomatrixserverlib.ServerName]resolvedServer),
+	}
+}
+
+// transport returns a transport which checks that certificates are valid for
+// the TLS server name, which isn't always the host that we connect to.
+func (t *httpsTransport) transport(tlsServerName string) *http.Transport {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	tr, ok := t.transports[tlsServerName]
+	if !ok {
+		tr = &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{ServerName: tlsServerName},
+		}
+		t.transports[tlsServerName] = tr
+	}
+	return tr
+}
+
+// resolve finds where to send requests for the server name, remembering the
+// answer for resolveCacheTTL.
+func (t *httpsTransport) resolve(serverName gomatrixserverlib.ServerName) ([]gomatrixserverlib.ResolutionResult, error) {
+	t.mutex.Lock()
+	cached, ok := t.resolved[serverName]
+	t.mutex.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.results, nil
+	}
+	results, err := gomatrixserverlib.ResolveServer(serverName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %s: %w", serverName, err)
+	}
+	if len(results) == 0 {
+		return nil, fmt.Errorf("no addresses found for %s", serverName)
+	}
+	t.mutex.Lock()
+	t.resolved[serverName] = resolvedServer{results: results, expires: time.Now().Add(resolveCacheTTL)}
+	t.mutex.Unlock()
+	return results, nil
+}
+
+// forget drops what we know about where the server name is, so that it is
+// resolved again next time.
+func (t *httpsTransport) forget(serverName gomatrixserverlib.ServerName) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	delete(t.resolved, serverName)
+}
+
+func (t *httpsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	serverName := gomatrixserverlib.ServerName(req.URL.Host)
+	results, err := t.resolve(serverName)
+	if err != nil {
+		return nil, err
+	}
+	for i, result := range results {
+		resolved := req.Clone(req.Context())
+		resolved.URL.Scheme = "https"
+		resolved.URL.Host = result.Destination
+		resolved.Host = string(result.Host)
+		// The body was used up by the previous attempt.
+		if i > 0 && req.GetBody != nil {
+			if resolved.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+		var resp *http.Response
+		if resp, err = t.transport(result.TLSServerName).RoundTrip(resolved); err == nil {
+			return resp, nil
+		}
+	}
+	// The server may have moved.
+	t.forget(serverName)
+	return nil, err
+}
+
+// gatewayHandler sends federation requests that other nodes send us for
+// homeservers with DNS names on to those homeservers over HTTPS, and passes
+// everything else on to the next handler. Only the federation and key APIs
+// are sent on, so that the gateway can't be used as a general proxy.
+func gatewayHandler(ourName gomatrixserverlib.ServerName, https http.RoundTripper, next http.Handler) http.Handler {
+	proxy := &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			req.URL.Scheme = "matrix"
+			req.URL.Host = req.Host
+		},
+		Transport: https,
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		host := req.Host
+		if host != "" && host != string(ourName) && !isP2PServerName(host) &&
+			(strings.HasPrefix(req.URL.Path, "/_matrix/federation/") || strings.HasPrefix(req.URL.Path, "/_matrix/key/")) {
+			proxy.ServeHTTP(w, req)
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
@@ -3,17 +3,26 @@ module github.com/lihram/server/v2
 go 1.13
 
 require (
+	github.com/ipfs/go-cid v0.0.5
+	github.com/lib/pq v1.2.0
 	github.com/libp2p/go-libp2p v0.6.0
 	github.com/libp2p/go-libp2p-circuit v0.1.4
 	github.com/libp2p/go-libp2p-core v0.5.0
+	github.com/libp2p/go-libp2p-discovery v0.2.0
 	github.com/libp2p/go-libp2p-gostream v0.2.1
 	github.com/libp2p/go-libp2p-http v0.1.5
 	github.com/libp2p/go-libp2p-kad-dht v0.5.0
 	github.com/libp2p/go-libp2p-pubsub v0.2.5
 	github.com/libp2p/go-libp2p-record v0.1.2
 	github.com/matrix-org/dendrite v0.0.0-20200511172139-32624697fd2d
+	github.com/matrix-org/gomatrix v0.0.0-20190528120928-7df988a63f26
 	github.com/matrix-org/gomatrixserverlib v0.0.0-20200511154227-5cc71d36632b
+	github.com/mattn/go-sqlite3 v2.0.2+incompatible
+	github.com/multiformats/go-multiaddr v0.2.1
+	github.com/multiformats/go-multihash v0.0.13
 	github.com/prometheus/client_golang v1.4.1
 	github.com/sirupsen/logrus v1.4.2
+	golang.org/x/crypto v0.0.0-20200221231518-2aa609cf4a9d
 	golang.org/x/mobile v0.0.0-20200329125638-4c31acba0007 // indirect
+	gopkg.in/yaml.v2 v2.2.8
 )
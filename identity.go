@@ -0,0 +1,342 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+)
+
+// identityFormat identifies the format of key files and identity bundles.
+const identityFormat = "dendrite-p2p-identity/1"
+
+// The scrypt parameters used to derive the encryption key from a passphrase.
+const (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+// identity is everything that makes a node who it is. The private key is the
+// libp2p identity, which determines our peer ID and so our server name, and
+// must never change. The signing keys sign our Matrix events and requests,
+// and can be rotated without changing who we are.
+type identity struct {
+	PrivateKey  ed25519.PrivateKey `json:"private_key"`
+	SigningKeys []signingKey       `json:"signing_keys"` // the last one is current
+}
+
+type signingKey struct {
+	KeyID      gomatrixserverlib.KeyID     `json:"key_id"`
+	PrivateKey ed25519.PrivateKey          `json:"private_key"`
+	ExpiredTS  gomatrixserverlib.Timestamp `json:"expired_ts,omitempty"` // 0 for the current key
+}
+
+// sealedIdentity is how an identity is stored in a key file or a bundle. If
+// it is encrypted, the identity is sealed with a key derived from the
+// passphrase and the salt.
+type sealedIdentity struct {
+	Format     string          `json:"format"`
+	Identity   json.RawMessage `json:"identity,omitempty"` // if not encrypted
+	Salt       []byte          `json:"salt,omitempty"`
+	Nonce      []byte          `json:"nonce,omitempty"`
+	Ciphertext []byte          `json:"ciphertext,omitempty"` // if encrypted
+}
+
+// newIdentity generates a new identity, whose first signing key is the
+// identity key itself, as it was before keys could be rotated.
+func newIdentity(instanceName string) (*identity, error) {
+	_, privKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		return nil, err
+	}
+	return legacyIdentity(instanceName, privKey), nil
+}
+
+// legacyIdentity returns the identity of a node whose key file holds just the
+// raw private key.
+func legacyIdentity(instanceName string, privKey ed25519.PrivateKey) *identity {
+	return &identity{
+		PrivateKey: privKey,
+		SigningKeys: []signingKey{{
+			KeyID:      gomatrixserverlib.KeyID("ed25519:" + instanceName),
+			PrivateKey: privKey,
+		}},
+	}
+}
+
+// currentSigningKey returns the key that we sign with.
+func (id *identity) currentSigningKey() signingKey {
+	return id.SigningKeys[len(id.SigningKeys)-1]
+}
+
+// oldVerifyKeys returns the public keys of the signing keys that have been
+// rotated out, with when they expired.
+func (id *identity) oldVerifyKeys() map[gomatrixserverlib.KeyID]gomatrixserverlib.OldVerifyKey {
+	keys := make(map[gomatrixserverlib.KeyID]gomatrixserverlib.OldVerifyKey)
+	for _, key := range id.SigningKeys[:len(id.SigningKeys)-1] {
+		keys[key.KeyID] = gomatrixserverlib.OldVerifyKey{
+			VerifyKey: gomatrixserverlib.VerifyKey{
+				Key: gomatrixserverlib.Base64String(key.PrivateKey.Public().(ed25519.PublicKey)),
+			},
+			ExpiredTS: key.ExpiredTS,
+		}
+	}
+	return keys
+}
+
+// rotate expires the current signing key and adds a new one.
+func (id *identity) rotate(instanceName string) error {
+	_, privKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	id.SigningKeys[len(id.SigningKeys)-1].ExpiredTS = gomatrixserverlib.AsTimestamp(now)
+	id.SigningKeys = append(id.SigningKeys, signingKey{
+		KeyID:      gomatrixserverlib.KeyID(fmt.Sprintf("ed25519:%s_%d", instanceName, now.Unix())),
+		PrivateKey: privKey,
+	})
+	return nil
+}
+
+func (id *identity) verify() error {
+	if len(id.PrivateKey) != ed25519.PrivateKeySize || len(id.SigningKeys) == 0 {
+		return fmt.Errorf("incomplete identity")
+	}
+	for _, key := range id.SigningKeys {
+		if len(key.PrivateKey) != ed25519.PrivateKeySize || key.KeyID == "" {
+			return fmt.Errorf("invalid signing key %q", key.KeyID)
+		}
+	}
+	return nil
+}
+
+// sealIdentity encodes the identity, encrypting it if a passphrase is given.
+func sealIdentity(id *identity, passphrase string) ([]byte, error) {
+	plaintext, err := json.Marshal(id)
+	if err != nil {
+		return nil, err
+	}
+	sealed := sealedIdentity{Format: identityFormat}
+	if passphrase == "" {
+		sealed.Identity = plaintext
+	} else {
+		sealed.Salt = make([]byte, 32)
+		if _, err = rand.Read(sealed.Salt); err != nil {
+			return nil, err
+		}
+		var nonce [24]byte
+		if _, err = rand.Read(nonce[:]); err != nil {
+			return nil, err
+		}
+		key, err := passphraseKey(passphrase, sealed.Salt)
+		if err != nil {
+			return nil, err
+		}
+		sealed.Nonce = nonce[:]
+		sealed.Ciphertext = secretbox.Seal(nil, plaintext, &nonce, key)
+	}
+	return json.MarshalIndent(sealed, "", "  ")
+}
+
+// openIdentity decodes an identity, decrypting it with the passphrase if it
+// is encrypted.
+func openIdentity(data []byte, passphrase string) (*identity, error) {
+	var sealed sealedIdentity
+	if err := json.Unmarshal(data, &sealed); err != nil {
+		return nil, fmt.Errorf("invalid identity: %w", err)
+	}
+	if sealed.Format != identityFormat {
+		return nil, fmt.Errorf("unknown identity format %q", sealed.Format)
+	}
+	plaintext := []byte(sealed.Identity)
+	if sealed.Ciphertext != nil {
+		if passphrase == "" {
+			return nil, fmt.Errorf("identity is encrypted, but no passphrase was given")
+		}
+		if len(sealed.Nonce) != 24 {
+			return nil, fmt.Errorf("invalid identity nonce")
+		}
+		key, err := passphraseKey(passphrase, sealed.Salt)
+		if err != nil {
+			return nil, err
+		}
+		var nonce [24]byte
+		copy(nonce[:], sealed.Nonce)
+		var ok bool
+		if plaintext, ok = secretbox.Open(nil, sealed.Ciphertext, &nonce, key); !ok {
+			return nil, fmt.Errorf("wrong passphrase or corrupted identity")
+		}
+	}
+	var id identity
+	if err := json.Unmarshal(plaintext, &id); err != nil {
+		return nil, fmt.Errorf("invalid identity: %w", err)
+	}
+	if err := id.verify(); err != nil {
+		return nil, err
+	}
+	return &id, nil
+}
+
+func passphraseKey(passphrase string, salt []byte) (*[32]byte, error) {
+	derived, err := scrypt.Key([]byte(passphrase), salt, scryptN, scryptR, scryptP, 32)
+	if err != nil {
+		return nil, err
+	}
+	var key [32]byte
+	copy(key[:], derived)
+	return &key, nil
+}
+
+// keyFile returns the path of the file that the identity is stored in.
+func (c *Config) keyFile() string {
+	return fmt.Sprintf("%s/%s-private.key", c.Path, c.InstanceName)
+}
+
+// loadIdentity reads the identity from the key file, or generates a new one
+// if the key file doesn't exist. It never generates a new identity if the
+// key file exists but can't be read, as that would change our server name.
+func (c *Config) loadIdentity() (*identity, error) {
+	id, err := c.readIdentity()
+	if errors.Is(err, os.ErrNotExist) {
+		if id, err = newIdentity(c.InstanceName); err != nil {
+			return nil, err
+		}
+		if err = c.saveIdentity(id); err != nil {
+			return nil, err
+		}
+	}
+	return id, err
+}
+
+// readIdentity reads the identity from the key file. Unlike loadIdentity, it
+// fails if the key file doesn't exist.
+func (c *Config) readIdentity() (*identity, error) {
+	filename := c.keyFile()
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read private key from file '%s': %w", filename, err)
+	}
+	id, err := openIdentity(data, c.KeyPassphrase)
+	if err != nil && len(data) == ed25519.PrivateKeySize {
+		// Key files used to hold just the raw private key, which is never a
+		// valid sealed identity.
+		id = legacyIdentity(c.InstanceName, ed25519.PrivateKey(data))
+		if c.KeyPassphrase != "" {
+			if err = c.saveIdentity(id); err != nil {
+				return nil, err
+			}
+		}
+		return id, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read private key from file '%s': %w", filename, err)
+	}
+	return id, nil
+}
+
+// saveIdentity writes the identity to the key file, encrypted with the
+// passphrase if there is one.
+func (c *Config) saveIdentity(id *identity) error {
+	return c.writeIdentity(id, c.KeyPassphrase)
+}
+
+// writeIdentity writes the identity to the key file, encrypted with the given
+// passphrase if it isn't empty. The file is replaced atomically so that a
+// failed write can't lose the identity.
+func (c *Config) writeIdentity(id *identity, passphrase string) error {
+	filename := c.keyFile()
+	data, err := sealIdentity(id, passphrase)
+	if err != nil {
+		return err
+	}
+	tmp := filename + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("couldn't write private key to file '%s': %w", tmp, err)
+	}
+	if err = os.Rename(tmp, filename); err != nil {
+		return fmt.Errorf("couldn't write private key to file '%s': %w", filename, err)
+	}
+	return nil
+}
+
+// ExportIdentity returns the identity of the instance as a bundle encrypted
+// with the given passphrase, which can be imported with ImportIdentity on
+// another device to move the instance there. The passphrase is required, as
+// the bundle holds the private keys. It fails if the instance has no identity
+// yet.
+func (c *Config) ExportIdentity(bundlePassphrase string) ([]byte, error) {
+	if bundlePassphrase == "" {
+		return nil, fmt.Errorf("a passphrase is required to export the identity")
+	}
+	id, err := c.readIdentity()
+	if err != nil {
+		return nil, err
+	}
+	return sealIdentity(id, bundlePassphrase)
+}
+
+// ImportIdentity replaces the identity of the instance with one from a bundle
+// made by ExportIdentity. It must not be called while the instance is
+// running, and the identity that it replaces is lost.
+func (c *Config) ImportIdentity(bundle []byte, bundlePassphrase string) error {
+	id, err := openIdentity(bundle, bundlePassphrase)
+	if err != nil {
+		return err
+	}
+	return c.saveIdentity(id)
+}
+
+// RotateSigningKey replaces the key that the instance signs Matrix events and
+// requests with. The old key is kept so that other nodes can still verify
+// what it signed, but is marked as expired. Our peer ID and server name stay
+// the same. It must not be called while the instance is running, and the new
+// key is used from the next start.
+func (c *Config) RotateSigningKey() error {
+	id, err := c.readIdentity()
+	if err != nil {
+		return err
+	}
+	if err = id.rotate(c.InstanceName); err != nil {
+		return err
+	}
+	return c.saveIdentity(id)
+}
+
+// ChangeKeyPassphrase re-encrypts the key file with a new passphrase, or
+// decrypts it if the new passphrase is empty. The config is updated to use
+// the new passphrase once the key file has been written.
+func (c *Config) ChangeKeyPassphrase(newPassphrase string) error {
+	id, err := c.readIdentity()
+	if err != nil {
+		return err
+	}
+	if err = c.writeIdentity(id, newPassphrase); err != nil {
+		return err
+	}
+	c.KeyPassphrase = newPassphrase
+	return nil
+}
@@ -0,0 +1,62 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package sqlutil opens the SQL databases that we keep alongside Dendrite's.
+package sqlutil
+
+import (
+	"database/sql"
+	"strconv"
+	"strings"
+)
+
+// SQLiteBusyTimeout is how long, in milliseconds, SQLite waits for another
+// connection to release a lock before giving up.
+const SQLiteBusyTimeout = 5000
+
+// Statement is a SQL statement to prepare, and where to put it.
+type Statement struct {
+	Stmt **sql.Stmt
+	SQL  string
+}
+
+// Open opens a database, creates the schema and prepares the statements. If
+// any of that fails, the database is closed again. SQLite databases wait for
+// locks held by other connections rather than failing straight away.
+func Open(driverName, dataSourceName, schema string, statements []Statement) (db *sql.DB, err error) {
+	if driverName == "sqlite3" && !strings.Contains(dataSourceName, "_busy_timeout=") {
+		separator := "?"
+		if strings.Contains(dataSourceName, "?") {
+			separator = "&"
+		}
+		dataSourceName += separator + "_busy_timeout=" + strconv.Itoa(SQLiteBusyTimeout)
+	}
+	if db, err = sql.Open(driverName, dataSourceName); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			db.Close() // nolint: errcheck
+		}
+	}()
+	if _, err = db.Exec(schema); err != nil {
+		return nil, err
+	}
+	for _, statement := range statements {
+		if *statement.Stmt, err = db.Prepare(statement.SQL); err != nil {
+			return nil, err
+		}
+	}
+	return db, nil
+}
@@ -0,0 +1,215 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+	"github.com/matrix-org/dendrite/common/keydb"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+)
+
+// keyExchangeProtocol is the libp2p protocol that nodes use to tell each other
+// which key IDs their Matrix signing keys have.
+const keyExchangeProtocol = protocol.ID("/matrix/keys/1.0.0")
+
+// keyExchangeTimeout is how long we wait for a peer to tell us its keys.
+const keyExchangeTimeout = time.Second * 10
+
+// keyExchangeAttempts is how many times we ask a peer for its keys before
+// giving up, in case it connected to us before it was ready to answer.
+const keyExchangeAttempts = 3
+
+// keyExchangeResponse is what a node sends to a peer that opens a stream with
+// keyExchangeProtocol. It is a subset of the /_matrix/key/v2/server response.
+// We don't need it to be signed, as the libp2p connection already proves that
+// it came from the peer.
+type keyExchangeResponse struct {
+	ServerName    gomatrixserverlib.ServerName                               `json:"server_name"`
+	VerifyKeys    map[gomatrixserverlib.KeyID]gomatrixserverlib.VerifyKey    `json:"verify_keys"`
+	OldVerifyKeys map[gomatrixserverlib.KeyID]gomatrixserverlib.OldVerifyKey `json:"old_verify_keys,omitempty"`
+}
+
+// keyExchange stores the keys of every peer that we connect to in the key
+// database, however we found them, so that we can verify their federation
+// requests and events. Peers that the filter doesn't accept are ignored.
+type keyExchange struct {
+	host       host.Host
+	keydb      keydb.Database
+	filter     *peerFilter
+	names      *nameService
+	ctx        context.Context
+	response   keyExchangeResponse
+	inProgress map[peer.ID]bool // peers we are currently exchanging keys with
+	mutex      sync.Mutex       // protects inProgress
+	notifiee   network.NotifyBundle
+}
+
+// newKeyExchange starts exchanging keys with peers. Our old keys are sent as
+// well as the current one, so that peers can verify what we signed before we
+// last rotated our key.
+func newKeyExchange(p2p *p2pDendrite, db keydb.Database, filter *peerFilter, names *nameService, oldKeys map[gomatrixserverlib.KeyID]gomatrixserverlib.OldVerifyKey) *keyExchange {
+	cfg := p2p.Base.Cfg.Matrix
+	k := &keyExchange{
+		host:   p2p.LibP2P,
+		keydb:  db,
+		filter: filter,
+		names:  names,
+		ctx:    p2p.LibP2PContext,
+		response: keyExchangeResponse{
+			ServerName: cfg.ServerName,
+			VerifyKeys: map[gomatrixserverlib.KeyID]gomatrixserverlib.VerifyKey{
+				cfg.KeyID: {
+					Key: gomatrixserverlib.Base64String(cfg.PrivateKey.Public().(ed25519.PublicKey)),
+				},
+			},
+			OldVerifyKeys: oldKeys,
+		},
+		inProgress: make(map[peer.ID]bool),
+	}
+	k.notifiee = network.NotifyBundle{
+		ConnectedF: func(_ network.Network, c network.Conn) {
+			go k.exchange(c.RemotePeer())
+		},
+	}
+	k.host.SetStreamHandler(keyExchangeProtocol, k.handleStream)
+	k.host.Network().Notify(&k.notifiee)
+	return k
+}
+
+// handleStream sends our keys to a peer that asked for them.
+func (k *keyExchange) handleStream(s network.Stream) {
+	defer s.Close() // nolint: errcheck
+	if !k.filter.accepts(s.Conn().RemotePeer()) {
+		return
+	}
+	_ = s.SetDeadline(time.Now().Add(keyExchangeTimeout))
+	if err := json.NewEncoder(s).Encode(k.response); err != nil {
+		logrus.WithError(err).Warn("Failed to send keys to peer ", s.Conn().RemotePeer())
+	}
+}
+
+// exchange asks a peer for its keys and stores them.
+func (k *keyExchange) exchange(p peer.ID) {
+	if !k.filter.accepts(p) {
+		return
+	}
+	k.mutex.Lock()
+	if k.inProgress[p] {
+		k.mutex.Unlock()
+		return
+	}
+	k.inProgress[p] = true
+	k.mutex.Unlock()
+	defer func() {
+		k.mutex.Lock()
+		delete(k.inProgress, p)
+		k.mutex.Unlock()
+	}()
+
+	var err error
+	for attempt := 1; attempt <= keyExchangeAttempts; attempt++ {
+		if err = k.fetchAndStoreKeys(p); err == nil {
+			return
+		}
+		select {
+		case <-k.ctx.Done():
+			return
+		case <-time.After(keyExchangeTimeout * time.Duration(attempt)):
+		}
+	}
+	logrus.WithError(err).Warn("Failed to exchange keys with peer ", p)
+}
+
+func (k *keyExchange) fetchAndStoreKeys(p peer.ID) error {
+	ctx, cancel := context.WithTimeout(k.ctx, keyExchangeTimeout)
+	defer cancel()
+	s, err := k.host.NewStream(ctx, p, keyExchangeProtocol)
+	if err != nil {
+		return err
+	}
+	defer s.Close() // nolint: errcheck
+	_ = s.SetDeadline(time.Now().Add(keyExchangeTimeout))
+
+	var response keyExchangeResponse
+	if err = json.NewDecoder(io.LimitReader(s, 64*1024)).Decode(&response); err != nil {
+		return fmt.Errorf("invalid response: %w", err)
+	}
+
+	// The server name of a peer is its peer ID, unless it has claimed a
+	// human-friendly name, so we only trust the server name in the response
+	// if the name has the peer's tag.
+	serverNames := []gomatrixserverlib.ServerName{gomatrixserverlib.ServerName(p.String())}
+	if name := string(response.ServerName); name != "" && name != p.String() {
+		if !k.names.owns(name, p) {
+			logrus.Warnf("Peer %s claims to be %s, but the name doesn't belong to it", p, name)
+		} else {
+			serverNames = append(serverNames, response.ServerName)
+		}
+	}
+	keys := map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{}
+	for _, serverName := range serverNames {
+		for keyID, verifyKey := range response.VerifyKeys {
+			if len(verifyKey.Key) != ed25519.PublicKeySize {
+				return fmt.Errorf("key %q has the wrong length", keyID)
+			}
+			keys[gomatrixserverlib.PublicKeyLookupRequest{
+				ServerName: serverName,
+				KeyID:      keyID,
+			}] = gomatrixserverlib.PublicKeyLookupResult{
+				VerifyKey:    verifyKey,
+				ValidUntilTS: math.MaxUint64 >> 1,
+				ExpiredTS:    gomatrixserverlib.PublicKeyNotExpired,
+			}
+		}
+		for keyID, oldKey := range response.OldVerifyKeys {
+			if len(oldKey.Key) != ed25519.PublicKeySize {
+				return fmt.Errorf("old key %q has the wrong length", keyID)
+			}
+			if _, ok := response.VerifyKeys[keyID]; ok {
+				continue
+			}
+			keys[gomatrixserverlib.PublicKeyLookupRequest{
+				ServerName: serverName,
+				KeyID:      keyID,
+			}] = gomatrixserverlib.PublicKeyLookupResult{
+				VerifyKey:    oldKey.VerifyKey,
+				ValidUntilTS: oldKey.ExpiredTS,
+				ExpiredTS:    oldKey.ExpiredTS,
+			}
+		}
+	}
+	// The peer may have been denied while we were waiting for its keys.
+	if !k.filter.accepts(p) {
+		return nil
+	}
+	if err = k.keydb.StoreKeys(ctx, keys); err != nil {
+		return fmt.Errorf("failed to store keys: %w", err)
+	}
+	logrus.Infof("Stored %d key(s) for peer %s", len(keys), p)
+	return nil
+}
@@ -0,0 +1,104 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/gomatrix"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// federationTimeout is how long the test waits for a federation request to
+// succeed, as names and keys are learnt in the background after connecting.
+const federationTimeout = 30 * time.Second
+
+func TestFederationBetweenInstanceNames(t *testing.T) {
+	// The instances have different names, and so different key IDs. The
+	// second one also has a .p2p server name, which has to be resolved.
+	servers, cleanup := startServers(t, 2, func(i int, c *Config) {
+		if i == 1 {
+			c.ServerName = "bob"
+		}
+	})
+	defer cleanup()
+	alice, bob := servers[0], servers[1]
+	aliceKeyID := alice.p2p.Base.Cfg.Matrix.KeyID
+	bobKeyID := bob.p2p.Base.Cfg.Matrix.KeyID
+	if aliceKeyID == bobKeyID {
+		t.Fatalf("both instances have key ID %s", aliceKeyID)
+	}
+	connectServers(t, servers)
+
+	federation := createFederationClient(alice.p2p, alice.filter, alice.names, newHTTPSTransport(), "")
+	bobName := gomatrixserverlib.ServerName(bob.ServerName())
+	ctx, cancel := context.WithTimeout(context.Background(), federationTimeout)
+	defer cancel()
+
+	// Alice can look up Bob's keys, under Bob's own key ID.
+	var keys gomatrixserverlib.ServerKeys
+	retry(ctx, t, func() (err error) {
+		keys, err = federation.GetServerKeys(ctx, bobName)
+		return
+	})
+	if keys.ServerName != bobName {
+		t.Errorf("got keys for %s, want %s", keys.ServerName, bobName)
+	}
+	if _, ok := keys.VerifyKeys[bobKeyID]; !ok {
+		t.Errorf("keys of %s don't include %s", bobName, bobKeyID)
+	}
+
+	// Bob checks the signature on Alice's request with Alice's key. The user
+	// doesn't exist, so the request fails, but not because of the signature.
+	retry(ctx, t, func() error {
+		_, err := federation.LookupProfile(ctx, bobName, "@nobody:"+string(bobName), "displayname")
+		if code, ok := httpErrorCode(err); ok && code != http.StatusUnauthorized && code != http.StatusForbidden {
+			return nil
+		}
+		return err
+	})
+}
+
+// retry calls f until it succeeds, failing the test if the context is done
+// first.
+func retry(ctx context.Context, t *testing.T, f func() error) {
+	t.Helper()
+	for {
+		err := f()
+		if err == nil {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatalf("gave up: %v", err)
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+}
+
+// httpErrorCode returns the status code of an error response from another
+// server.
+func httpErrorCode(err error) (int, bool) {
+	switch e := err.(type) {
+	case gomatrix.HTTPError:
+		return e.Code, true
+	case *gomatrix.HTTPError:
+		return e.Code, true
+	}
+	return 0, false
+}
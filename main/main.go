@@ -18,6 +18,7 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"os"
 
 	"github.com/lihram/server/v2"
@@ -28,22 +29,32 @@ func main() {
 	instanceName := flag.String("name", "dendrite-p2p", "the name of this P2P demo instance")
 	instancePort := flag.Int("port", 0, "the port that the client API will listen on")
 	instancePath := flag.String("path", "./build", "the path where databases will be stored")
+	configFile := flag.String("config", "", "a YAML or JSON config file, which replaces the other flags")
 	flag.Parse()
 
+	cfg := server.NewConfig(*instancePath, *instanceName)
+	cfg.ListenAddress = fmt.Sprintf(":%d", *instancePort)
+	if *configFile != "" {
+		var err error
+		if cfg, err = server.LoadConfig(*configFile); err != nil {
+			logrus.WithError(err).Fatal("Failed to load config file")
+		}
+	}
+
 	// Create the build directory if it does not exist
-	if _, err := os.Stat(*instancePath); os.IsNotExist(err) {
-		err := os.MkdirAll(*instancePath, 0755)
+	if _, err := os.Stat(cfg.Path); os.IsNotExist(err) {
+		err := os.MkdirAll(cfg.Path, 0755)
 		if err != nil {
-			panic(nil)
+			logrus.WithError(err).Fatal("Failed to create instance path")
 		}
 	}
 
-	server.Init(
-		*instancePath,
-		*instanceName,
-		*instancePort,
-		simpleCallback{},
-	)
+	if _, err := server.StartWithConfig(cfg, simpleCallback{}); err != nil {
+		logrus.WithError(err).Fatal("Failed to start Dendrite")
+	}
+
+	// We want to block forever to let the HTTP and HTTPS handler serve the APIs
+	select {}
 }
 
 type simpleCallback struct{}
@@ -51,3 +62,27 @@ type simpleCallback struct{}
 func (cb simpleCallback) SetPort(port int) {
 	logrus.Info("Listening on :", port)
 }
+
+func (cb simpleCallback) OnReady() {
+	logrus.Info("Ready")
+}
+
+func (cb simpleCallback) OnPeerDiscovered(peerID string) {
+	logrus.Info("Discovered peer ", peerID)
+}
+
+func (cb simpleCallback) OnPeerLost(peerID string) {
+	logrus.Info("Lost peer ", peerID)
+}
+
+func (cb simpleCallback) OnListenAddrsChanged(addrs string) {
+	logrus.Info("Listening on libp2p addresses:\n", addrs)
+}
+
+func (cb simpleCallback) OnPublicRoomCountChanged(count int) {
+	logrus.Info("Now know of ", count, " public room(s)")
+}
+
+func (cb simpleCallback) OnError(message string) {
+	logrus.Error(message)
+}
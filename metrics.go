@@ -0,0 +1,188 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func newPeersDiscovered() *prometheus.CounterVec {
+	return prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "dendrite",
+			Subsystem: "p2p",
+			Name:      "peers_discovered_total",
+			Help:      "Number of times that a peer we weren't connected to was found, by discovery source, e.g. mDNS.",
+		},
+		[]string{"source"},
+	)
+}
+
+var (
+	connectedPeersDesc = prometheus.NewDesc(
+		"dendrite_p2p_connected_peers",
+		"Number of libp2p peers that we are connected to.",
+		nil, nil,
+	)
+	knownPeersDesc = prometheus.NewDesc(
+		"dendrite_p2p_known_peers",
+		"Number of libp2p peers in the peerstore.",
+		nil, nil,
+	)
+	protocolBytesDesc = prometheus.NewDesc(
+		"dendrite_p2p_protocol_bytes_total",
+		"Number of bytes sent and received by libp2p, by protocol and direction.",
+		[]string{"protocol", "direction"}, nil,
+	)
+)
+
+// p2pCollector collects the metrics of the libp2p host of a server. Most of
+// them are read from the host when scraped, rather than being counted as
+// they happen.
+type p2pCollector struct {
+	p2p             *p2pDendrite
+	peersDiscovered *prometheus.CounterVec // counted by peerNotifee
+}
+
+// Describe implements prometheus.Collector.
+func (c *p2pCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- connectedPeersDesc
+	ch <- knownPeersDesc
+	ch <- protocolBytesDesc
+	c.peersDiscovered.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (c *p2pCollector) Collect(ch chan<- prometheus.Metric) {
+	c.peersDiscovered.Collect(ch)
+	ch <- prometheus.MustNewConstMetric(
+		connectedPeersDesc, prometheus.GaugeValue,
+		float64(len(c.p2p.LibP2P.Network().Peers())),
+	)
+	ch <- prometheus.MustNewConstMetric(
+		knownPeersDesc, prometheus.GaugeValue,
+		float64(len(c.p2p.LibP2P.Peerstore().Peers())),
+	)
+	for protocol, stats := range c.p2p.LibP2PBandwidth.GetBandwidthByProtocol() {
+		ch <- prometheus.MustNewConstMetric(
+			protocolBytesDesc, prometheus.CounterValue,
+			float64(stats.TotalIn), string(protocol), "in",
+		)
+		ch <- prometheus.MustNewConstMetric(
+			protocolBytesDesc, prometheus.CounterValue,
+			float64(stats.TotalOut), string(protocol), "out",
+		)
+	}
+}
+
+// registerMetrics registers the metrics of this server with the default
+// registry, which is served on /metrics. They are labelled with the server
+// name, so that several servers can be registered side by side.
+func (s *Server) registerMetrics() error {
+	r := s.metricsRegisterer()
+	if err := r.Register(s.metrics); err != nil {
+		return err
+	}
+	if collector, ok := s.publicRoomsDB.(prometheus.Collector); ok {
+		if err := r.Register(collector); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unregisterMetrics unregisters the collectors of this server, including the
+// ones that the Dendrite components registered.
+func (s *Server) unregisterMetrics() {
+	s.metricsMutex.Lock()
+	defer s.metricsMutex.Unlock()
+	for _, unregister := range s.unregisters {
+		unregister()
+	}
+	s.unregisters = nil
+}
+
+// metricsRegisterer returns a registerer which labels the metrics of this
+// server with its server name, and remembers them so that they can be
+// unregistered when the server stops.
+func (s *Server) metricsRegisterer() prometheus.Registerer {
+	return &serverRegisterer{
+		server: s,
+		inner: prometheus.WrapRegistererWith(
+			prometheus.Labels{"server_name": string(s.p2p.Base.Cfg.Matrix.ServerName)},
+			prometheus.DefaultRegisterer,
+		),
+	}
+}
+
+// dendriteMetricsMutex is held while the Dendrite components of a server are
+// set up, as prometheus.DefaultRegisterer is replaced in the meantime.
+var dendriteMetricsMutex sync.Mutex
+
+// useServerRegisterer makes the metrics that the Dendrite components register
+// with prometheus.DefaultRegisterer be metrics of this server, so that they
+// don't clash with the same metrics of other servers in the process. The
+// returned function puts the default registerer back, and may be called more
+// than once.
+func (s *Server) useServerRegisterer() (restore func()) {
+	dendriteMetricsMutex.Lock()
+	previous := prometheus.DefaultRegisterer
+	prometheus.DefaultRegisterer = s.metricsRegisterer()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			prometheus.DefaultRegisterer = previous
+			dendriteMetricsMutex.Unlock()
+		})
+	}
+}
+
+// serverRegisterer is a prometheus.Registerer for the metrics of a server.
+// Collectors that are already registered, e.g. by a server with the same name
+// that ran earlier in the process, are left in place rather than panicking.
+type serverRegisterer struct {
+	server *Server
+	inner  prometheus.Registerer
+}
+
+func (r *serverRegisterer) Register(c prometheus.Collector) error {
+	if err := r.inner.Register(c); err != nil {
+		return err
+	}
+	r.server.metricsMutex.Lock()
+	defer r.server.metricsMutex.Unlock()
+	// Unregister through the wrapping registerer, as the collector was
+	// registered with the default registry with our label added.
+	r.server.unregisters = append(r.server.unregisters, func() bool {
+		return r.inner.Unregister(c)
+	})
+	return nil
+}
+
+func (r *serverRegisterer) MustRegister(cs ...prometheus.Collector) {
+	for _, c := range cs {
+		if err := r.Register(c); err != nil {
+			if _, ok := err.(prometheus.AlreadyRegisteredError); !ok {
+				panic(err)
+			}
+		}
+	}
+}
+
+func (r *serverRegisterer) Unregister(c prometheus.Collector) bool {
+	return r.inner.Unregister(c)
+}
@@ -0,0 +1,299 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lihram/server/v2/signedrecord"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/peer"
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/sirupsen/logrus"
+)
+
+// NameSuffix is the suffix of every human-friendly server name, so that they
+// can't be mistaken for DNS names.
+const NameSuffix = ".p2p"
+
+// NamePubSubTopic is the pubsub topic that nodes announce their names on, so
+// that nodes which can't reach the DHT still learn them.
+const NamePubSubTopic = "/matrix/names"
+
+// NameRecordTTL is how long a name record is valid for, and
+// NameRepublishInterval is how often we publish ours again.
+const (
+	NameRecordTTL         = time.Hour
+	NameRepublishInterval = time.Minute * 10
+)
+
+// nameKeyPrefix is the DHT key prefix that name records are stored under,
+// followed by the name.
+const nameKeyPrefix = "/" + signedrecord.Namespace + "/" + signedrecord.NamesKind + "/"
+
+// nameResolveTimeout is how long we look for a name in the DHT.
+const nameResolveTimeout = time.Second * 10
+
+// nameLabel matches the part of a name before NameSuffix.
+var nameLabel = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// maxNameLabelLength is the longest label that can be configured, leaving
+// room for the tag in a name label.
+const maxNameLabelLength = 63 - len("-") - 12
+
+// validName returns an error if the name isn't a valid human-friendly server
+// name, e.g. alice-phone-ab3dxk7pq2mz.p2p. It doesn't check whose it is.
+func validName(name string) error {
+	if !strings.HasSuffix(name, NameSuffix) || !nameLabel.MatchString(strings.TrimSuffix(name, NameSuffix)) {
+		return fmt.Errorf("server name %q must be lower case letters, digits and dashes followed by %q", name, NameSuffix)
+	}
+	return nil
+}
+
+// validNameLabel returns an error if the label can't be used to make a server
+// name, e.g. alice-phone.
+func validNameLabel(label string) error {
+	if len(label) > maxNameLabelLength || !nameLabel.MatchString(label) {
+		return fmt.Errorf("server name %q must be at most %d lower case letters, digits and dashes", label, maxNameLabelLength)
+	}
+	return nil
+}
+
+// nameFor returns the name of the peer with the given label, e.g.
+// alice-phone-ab3dxk7pq2mz.p2p. The tag at the end is derived from the peer
+// ID, so nobody else can claim the name.
+func nameFor(label string, p peer.ID) string {
+	return label + "-" + signedrecord.NameTag(p) + NameSuffix
+}
+
+// nameClaim is a message on the names topic. The record is the same signed
+// envelope that is put into the DHT.
+type nameClaim struct {
+	Name   string `json:"name"`
+	Record []byte `json:"record"`
+}
+
+type nameEntry struct {
+	peer    peer.ID
+	expires time.Time
+}
+
+// nameService publishes our name, if we have one, and resolves the names of
+// other nodes to their peer IDs. Every name ends with the tag of the peer
+// that it belongs to, so claims by any other peer are refused.
+type nameService struct {
+	host    host.Host
+	dht     *dht.IpfsDHT
+	privKey crypto.PrivKey
+	name    string // our name, or empty if we don't have one
+	topic   *pubsub.Topic
+	sub     *pubsub.Subscription
+	names   map[string]nameEntry // names that we know, to their owners
+	mutex   sync.RWMutex         // protects names
+}
+
+func newNameService(p2p *p2pDendrite, name string, topicName string) (*nameService, error) {
+	topic, err := p2p.LibP2PPubsub.Join(topicName)
+	if err != nil {
+		return nil, err
+	}
+	sub, err := topic.Subscribe()
+	if err != nil {
+		topic.Close() // nolint: errcheck
+		return nil, err
+	}
+	return &nameService{
+		host:    p2p.LibP2P,
+		dht:     p2p.LibP2PDHT,
+		privKey: p2p.LibP2P.Peerstore().PrivKey(p2p.LibP2P.ID()),
+		name:    name,
+		topic:   topic,
+		sub:     sub,
+		names:   make(map[string]nameEntry),
+	}, nil
+}
+
+// start listens for name claims and publishes our name until the context is
+// cancelled.
+func (n *nameService) start(ctx context.Context) {
+	go func() {
+		<-ctx.Done()
+		n.sub.Cancel()
+		n.topic.Close() // nolint: errcheck
+	}()
+	go n.receive(ctx)
+	if n.name == "" {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(NameRepublishInterval)
+		defer ticker.Stop()
+		for {
+			n.publish(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// publish puts our name record into the DHT and announces it on pubsub.
+func (n *nameService) publish(ctx context.Context) {
+	key := nameKeyPrefix + n.name
+	record, err := signedrecord.Seal(n.privKey, key, []byte(n.host.ID().String()), NameRecordTTL)
+	if err != nil {
+		logrus.WithError(err).Warn("Failed to sign name record")
+		return
+	}
+	claim, err := json.Marshal(nameClaim{Name: n.name, Record: record})
+	if err != nil {
+		return
+	}
+	if err = n.topic.Publish(ctx, claim); err != nil {
+		logrus.WithError(err).Warn("Failed to announce name")
+	}
+	if err = n.dht.PutValue(ctx, key, record); err != nil {
+		logrus.WithError(err).Warn("Failed to put name record into the DHT")
+	}
+}
+
+func (n *nameService) receive(ctx context.Context) {
+	for {
+		msg, err := n.sub.Next(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			continue
+		}
+		from := msg.GetFrom()
+		if from == n.host.ID() {
+			continue
+		}
+		var claim nameClaim
+		if err = json.Unmarshal(msg.Data, &claim); err != nil {
+			continue
+		}
+		owner, expires, err := openNameRecord(claim.Name, claim.Record)
+		if err != nil || owner != from {
+			continue
+		}
+		n.learn(claim.Name, owner, expires)
+	}
+}
+
+// openNameRecord checks a signed name record and returns the peer that owns
+// the name and when the record expires.
+func openNameRecord(name string, record []byte) (peer.ID, time.Time, error) {
+	if err := validName(name); err != nil {
+		return "", time.Time{}, err
+	}
+	e, err := signedrecord.Open(nameKeyPrefix+name, record)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	owner, err := peer.IDB58Decode(string(e.Value))
+	if err != nil || owner != e.Publisher || !signedrecord.NameBelongsTo(name, owner) {
+		return "", time.Time{}, fmt.Errorf("name record for %q was not published by its owner", name)
+	}
+	return owner, time.Unix(0, e.Expires*int64(time.Millisecond)), nil
+}
+
+// learn remembers that the name belongs to the peer until its record
+// expires. The record must have been checked with openNameRecord.
+func (n *nameService) learn(name string, p peer.ID, expires time.Time) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.names[name] = nameEntry{peer: p, expires: expires}
+}
+
+func (n *nameService) cached(name string) (peer.ID, bool) {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+	entry, ok := n.names[name]
+	if !ok || time.Now().After(entry.expires) {
+		return "", false
+	}
+	return entry.peer, true
+}
+
+// resolve returns the peer ID that a name belongs to, looking for it in the
+// DHT if we haven't seen it announced.
+func (n *nameService) resolve(ctx context.Context, name string) (peer.ID, error) {
+	if name == n.name {
+		return n.host.ID(), nil
+	}
+	if p, ok := n.cached(name); ok {
+		return p, nil
+	}
+	if err := validName(name); err != nil {
+		return "", err
+	}
+	ctx, cancel := context.WithTimeout(ctx, nameResolveTimeout)
+	defer cancel()
+	record, err := n.dht.GetValue(ctx, nameKeyPrefix+name)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %s: %w", name, err)
+	}
+	owner, expires, err := openNameRecord(name, record)
+	if err != nil {
+		return "", err
+	}
+	n.learn(name, owner, expires)
+	return owner, nil
+}
+
+// owns returns whether the server name belongs to the peer, either because it
+// is the peer ID or because it is a name with the peer's tag. It only looks
+// at the name, so it works for names that we haven't seen announced yet and
+// is fast enough for validators.
+func (n *nameService) owns(serverName string, p peer.ID) bool {
+	if serverName == p.String() {
+		return true
+	}
+	return validName(serverName) == nil && signedrecord.NameBelongsTo(serverName, p)
+}
+
+// nameResolvingTransport resolves human-friendly server names in request URLs
+// to peer IDs, so that the libp2p HTTP transport can dial them.
+type nameResolvingTransport struct {
+	names *nameService
+	inner http.RoundTripper
+}
+
+func (t *nameResolvingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !strings.HasSuffix(req.URL.Hostname(), NameSuffix) {
+		return t.inner.RoundTrip(req)
+	}
+	p, err := t.names.resolve(req.Context(), req.URL.Hostname())
+	if err != nil {
+		return nil, err
+	}
+	resolved := req.Clone(req.Context())
+	resolved.URL.Host = p.String()
+	return t.inner.RoundTrip(resolved)
+}
@@ -16,21 +16,23 @@ package server
 
 import (
 	"context"
+	"crypto/ed25519"
 	"fmt"
 
-	"errors"
-
-	pstore "github.com/libp2p/go-libp2p-core/peerstore"
-	record "github.com/libp2p/go-libp2p-record"
+	"github.com/lihram/server/v2/signedrecord"
 	"github.com/matrix-org/dendrite/common/basecomponent"
 
 	"github.com/libp2p/go-libp2p"
 	circuit "github.com/libp2p/go-libp2p-circuit"
 	crypto "github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/metrics"
 	routing "github.com/libp2p/go-libp2p-core/routing"
 
 	host "github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
 	dht "github.com/libp2p/go-libp2p-kad-dht"
+	dhtopts "github.com/libp2p/go-libp2p-kad-dht/opts"
 	pubsub "github.com/libp2p/go-libp2p-pubsub"
 	"github.com/matrix-org/gomatrixserverlib"
 
@@ -48,79 +50,123 @@ type p2pDendrite struct {
 	LibP2PCancel  context.CancelFunc
 	LibP2PDHT     *dht.IpfsDHT
 	LibP2PPubsub  *pubsub.PubSub
+	// LibP2PBandwidth counts the bytes sent and received by libp2p.
+	LibP2PBandwidth *metrics.BandwidthCounter
+	// LibP2PNamespace names the private network that we are in, or is empty
+	// if we aren't in one.
+	LibP2PNamespace string
 }
 
 // newP2PDendrite creates a new instance to be used by a component.
 // The componentName is used for logging purposes, and should be a friendly name
 // of the component running, e.g. SyncAPI.
-func newP2PDendrite(cfg *config.Dendrite, componentName string) *p2pDendrite {
-	baseDendrite := basecomponent.NewBaseDendrite(cfg, componentName)
+func newP2PDendrite(cfg *config.Dendrite, p2pCfg *Config, identityKey ed25519.PrivateKey, componentName string) (*p2pDendrite, error) {
+	privKey, err := crypto.UnmarshalEd25519PrivateKey(identityKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load private key: %w", err)
+	}
 
-	ctx, cancel := context.WithCancel(context.Background())
+	psk, err := p2pCfg.privateNetworkKey()
+	if err != nil {
+		return nil, err
+	}
+	namespace := networkNamespace(psk)
 
-	privKey, err := crypto.UnmarshalEd25519PrivateKey(cfg.Matrix.PrivateKey[:])
+	// Our server name is our peer ID, unless we have a human-friendly name.
+	// It has to be set before the Dendrite components are created.
+	peerID, err := peer.IDFromPrivateKey(privKey)
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("failed to get peer ID: %w", err)
 	}
+	if p2pCfg.ServerName != "" {
+		cfg.Matrix.ServerName = gomatrixserverlib.ServerName(nameFor(p2pCfg.ServerName, peerID))
+	} else {
+		cfg.Matrix.ServerName = gomatrixserverlib.ServerName(peerID.String())
+	}
+
+	baseDendrite := basecomponent.NewBaseDendrite(cfg, componentName)
+
+	ctx, cancel := context.WithCancel(context.Background())
 
-	//defaultIP6ListenAddr, _ := multiaddr.NewMultiaddr("/ip6/::/tcp/0")
 	var libp2pdht *dht.IpfsDHT
-	libp2p, err := libp2p.New(ctx,
+	var dhtOpts []dhtopts.Option
+	if namespace != "" {
+		dhtOpts = append(dhtOpts, dhtopts.Protocols(protocol.ID("/matrix/"+namespace+"/kad/1.0.0")))
+	}
+	bandwidth := metrics.NewBandwidthCounter()
+	options := []libp2p.Option{
 		libp2p.Identity(privKey),
-		libp2p.DefaultListenAddrs,
-		//libp2p.ListenAddrs(defaultIP6ListenAddr),
 		libp2p.DefaultTransports,
+		libp2p.BandwidthReporter(bandwidth),
 		libp2p.Routing(func(h host.Host) (r routing.PeerRouting, err error) {
-			libp2pdht, err = dht.New(ctx, h)
+			libp2pdht, err = dht.New(ctx, h, dhtOpts...)
 			if err != nil {
 				return nil, err
 			}
-			libp2pdht.Validator = libP2PValidator{}
+			libp2pdht.Validator = signedrecord.Validator{}
 			r = libp2pdht
 			return
 		}),
-		libp2p.EnableAutoRelay(),
-		libp2p.EnableRelay(circuit.OptHop),
-	)
+	}
+	if psk != nil {
+		options = append(options, libp2p.PrivateNetwork(psk))
+	}
+	if len(p2pCfg.LibP2PListenAddresses) > 0 {
+		options = append(options, libp2p.ListenAddrStrings(p2pCfg.LibP2PListenAddresses...))
+	} else {
+		options = append(options, libp2p.DefaultListenAddrs)
+	}
+	if p2pCfg.RelayEnabled {
+		var relayOpts []circuit.RelayOpt
+		if p2pCfg.RelayHop {
+			relayOpts = append(relayOpts, circuit.OptHop)
+		}
+		options = append(options, libp2p.EnableRelay(relayOpts...))
+		if p2pCfg.AutoRelay {
+			options = append(options, libp2p.EnableAutoRelay())
+		}
+	} else {
+		options = append(options, libp2p.DisableRelay())
+	}
+	libp2p, err := libp2p.New(ctx, options...)
 	if err != nil {
-		panic(err)
+		cancel()
+		baseDendrite.Close() // nolint: errcheck
+		return nil, fmt.Errorf("failed to create libp2p host: %w", err)
 	}
 
-	libp2ppubsub, err := pubsub.NewFloodSub(context.Background(), libp2p, []pubsub.Option{
+	pubsubOpts := []pubsub.Option{
 		pubsub.WithMessageSigning(true),
-	}...)
+		pubsub.WithStrictSignatureVerification(true),
+	}
+	var libp2ppubsub *pubsub.PubSub
+	switch p2pCfg.PubSubRouter {
+	case PubSubRouterFloodSub:
+		libp2ppubsub, err = pubsub.NewFloodSub(ctx, libp2p, pubsubOpts...)
+	case PubSubRouterRandomSub:
+		libp2ppubsub, err = pubsub.NewRandomSub(ctx, libp2p, pubsubOpts...)
+	default:
+		libp2ppubsub, err = pubsub.NewGossipSub(ctx, libp2p, pubsubOpts...)
+	}
 	if err != nil {
-		panic(err)
+		cancel()
+		libp2p.Close()       // nolint: errcheck
+		baseDendrite.Close() // nolint: errcheck
+		return nil, fmt.Errorf("failed to create libp2p pubsub: %w", err)
 	}
 
 	fmt.Println("Our public key:", privKey.GetPublic())
 	fmt.Println("Our node ID:", libp2p.ID())
 	fmt.Println("Our addresses:", libp2p.Addrs())
 
-	cfg.Matrix.ServerName = gomatrixserverlib.ServerName(libp2p.ID().String())
-
 	return &p2pDendrite{
-		Base:          *baseDendrite,
-		LibP2P:        libp2p,
-		LibP2PContext: ctx,
-		LibP2PCancel:  cancel,
-		LibP2PDHT:     libp2pdht,
-		LibP2PPubsub:  libp2ppubsub,
-	}
-}
-
-type libP2PValidator struct {
-	KeyBook pstore.KeyBook
-}
-
-func (v libP2PValidator) Validate(key string, value []byte) error {
-	ns, _, err := record.SplitKey(key)
-	if err != nil || ns != "matrix" {
-		return errors.New("not Matrix path")
-	}
-	return nil
-}
-
-func (v libP2PValidator) Select(k string, vals [][]byte) (int, error) {
-	return 0, nil
+		Base:            *baseDendrite,
+		LibP2P:          libp2p,
+		LibP2PContext:   ctx,
+		LibP2PCancel:    cancel,
+		LibP2PDHT:       libp2pdht,
+		LibP2PPubsub:    libp2ppubsub,
+		LibP2PBandwidth: bandwidth,
+		LibP2PNamespace: namespace,
+	}, nil
 }
@@ -0,0 +1,353 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/lihram/server/v2/internal/sqlutil"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/matrix-org/dendrite/common/keydb"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// The rules that a peer can have in the peer filter.
+const (
+	PeerRuleAllow = "allow"
+	PeerRuleDeny  = "deny"
+	// PeerRuleNone is returned for peers that aren't in the filter.
+	PeerRuleNone = ""
+)
+
+// PeerFilterCallback can optionally be implemented by a Callback to decide
+// whether to accept peers that are neither allowed nor denied in the filter,
+// e.g. by asking the user. The answer is remembered until the server stops
+// or the rule for the peer changes, so the callback should call
+// Server.AllowPeer or Server.DenyPeer if it should be kept for longer.
+type PeerFilterCallback interface {
+	IsPeerAllowed(peerID string) bool
+}
+
+const peerFilterSchema = `
+-- Stores the peers that we always or never accept connections from.
+CREATE TABLE IF NOT EXISTS p2p_peer_filter (
+    peer_id TEXT NOT NULL PRIMARY KEY,
+    -- Either 'allow' or 'deny'.
+    rule TEXT NOT NULL,
+    -- When the rule was set.
+    added_ts BIGINT NOT NULL
+);
+`
+
+const upsertPeerRuleSQL = "" +
+	"INSERT INTO p2p_peer_filter (peer_id, rule, added_ts) VALUES ($1, $2, $3)" +
+	" ON CONFLICT (peer_id) DO UPDATE SET rule = $2, added_ts = $3"
+
+const deletePeerRuleSQL = "" +
+	"DELETE FROM p2p_peer_filter WHERE peer_id = $1"
+
+const selectPeerRulesSQL = "" +
+	"SELECT peer_id, rule FROM p2p_peer_filter"
+
+// peerFilter decides which peers we accept. Denied peers are always refused,
+// allowed peers are always accepted, and any others are accepted unless we
+// only accept allowed peers. Connections to peers that aren't accepted are
+// closed as soon as they are made, we don't dial them when they are
+// discovered, we don't send them federation requests or answer theirs, and
+// we never use their keys.
+type peerFilter struct {
+	db                 *sql.DB
+	allowlistOnly      bool
+	callback           PeerFilterCallback // nil if the callback doesn't decide
+	rules              map[peer.ID]string
+	decisions          map[peer.ID]bool // what the callback said about peers without rules
+	mutex              sync.RWMutex     // protects rules and decisions
+	notifiee           network.NotifyBundle
+	upsertPeerRuleStmt *sql.Stmt
+	deletePeerRuleStmt *sql.Stmt
+}
+
+func newPeerFilter(dataSourceName string, allowlistOnly bool, callback Callback) (*peerFilter, error) {
+	f := &peerFilter{
+		allowlistOnly: allowlistOnly,
+		rules:         make(map[peer.ID]string),
+		decisions:     make(map[peer.ID]bool),
+	}
+	f.callback, _ = callback.(PeerFilterCallback)
+	f.notifiee = network.NotifyBundle{
+		ConnectedF: func(_ network.Network, c network.Conn) {
+			// The callback may take a while to answer, so don't hold up the
+			// swarm while it does.
+			go func() {
+				if !f.accepts(c.RemotePeer()) {
+					c.Close() // nolint: errcheck
+				}
+			}()
+		},
+	}
+	var err error
+	f.db, err = sqlutil.Open("sqlite3", dataSourceName, peerFilterSchema, []sqlutil.Statement{
+		{Stmt: &f.upsertPeerRuleStmt, SQL: upsertPeerRuleSQL},
+		{Stmt: &f.deletePeerRuleStmt, SQL: deletePeerRuleSQL},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err = f.load(); err != nil {
+		f.db.Close() // nolint: errcheck
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *peerFilter) load() error {
+	rows, err := f.db.Query(selectPeerRulesSQL)
+	if err != nil {
+		return err
+	}
+	defer rows.Close() // nolint: errcheck
+	for rows.Next() {
+		var peerID, rule string
+		if err = rows.Scan(&peerID, &rule); err != nil {
+			return err
+		}
+		p, err := peer.IDB58Decode(peerID)
+		if err != nil {
+			continue
+		}
+		f.rules[p] = rule
+	}
+	return rows.Err()
+}
+
+// accepts returns whether we should connect to and exchange keys with the
+// peer.
+func (f *peerFilter) accepts(p peer.ID) bool {
+	switch f.rule(p) {
+	case PeerRuleAllow:
+		return true
+	case PeerRuleDeny:
+		return false
+	}
+	if f.callback != nil {
+		return f.decide(p)
+	}
+	return !f.allowlistOnly
+}
+
+// decide asks the callback whether to accept a peer without a rule, unless
+// it has already been asked.
+func (f *peerFilter) decide(p peer.ID) bool {
+	f.mutex.RLock()
+	allowed, ok := f.decisions[p]
+	f.mutex.RUnlock()
+	if ok {
+		return allowed
+	}
+	allowed = f.callback.IsPeerAllowed(p.String())
+	f.mutex.Lock()
+	f.decisions[p] = allowed
+	f.mutex.Unlock()
+	return allowed
+}
+
+// acceptsServer returns whether we should talk to the server with the given
+// name. Server names that don't belong to libp2p nodes, or names whose owner
+// we don't know yet, are always accepted.
+func (f *peerFilter) acceptsServer(serverName gomatrixserverlib.ServerName, names *nameService) bool {
+	if p, err := peer.IDB58Decode(string(serverName)); err == nil {
+		return f.accepts(p)
+	}
+	if p, ok := names.cached(string(serverName)); ok {
+		return f.accepts(p)
+	}
+	return true
+}
+
+// handler refuses requests from peers that the filter doesn't accept. It
+// must only be used on the libp2p listener, where the remote address of a
+// request is the peer ID.
+func (f *peerFilter) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		p, err := peer.IDB58Decode(req.RemoteAddr)
+		if err != nil || !f.accepts(p) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+func (f *peerFilter) rule(p peer.ID) string {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	return f.rules[p]
+}
+
+// rulesByPeer returns a copy of all of the rules.
+func (f *peerFilter) rulesByPeer() map[peer.ID]string {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	rules := make(map[peer.ID]string, len(f.rules))
+	for p, rule := range f.rules {
+		rules[p] = rule
+	}
+	return rules
+}
+
+// setRule stores the rule for the peer, or removes it if the rule is
+// PeerRuleNone.
+func (f *peerFilter) setRule(ctx context.Context, p peer.ID, rule string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	delete(f.decisions, p)
+	switch rule {
+	case PeerRuleAllow, PeerRuleDeny:
+		now := gomatrixserverlib.AsTimestamp(time.Now())
+		if _, err := f.upsertPeerRuleStmt.ExecContext(ctx, p.String(), rule, now); err != nil {
+			return err
+		}
+		f.rules[p] = rule
+	case PeerRuleNone:
+		if _, err := f.deletePeerRuleStmt.ExecContext(ctx, p.String()); err != nil {
+			return err
+		}
+		delete(f.rules, p)
+	default:
+		return fmt.Errorf("unknown peer rule %q", rule)
+	}
+	return nil
+}
+
+func (f *peerFilter) close() error {
+	return f.db.Close()
+}
+
+// peerFilterTransport refuses to send requests to peers that the filter
+// doesn't accept. It must be given URLs whose host is a peer ID.
+type peerFilterTransport struct {
+	filter *peerFilter
+	inner  http.RoundTripper
+}
+
+func (t *peerFilterTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	p, err := peer.IDB58Decode(req.URL.Hostname())
+	if err != nil {
+		return nil, fmt.Errorf("invalid peer ID %q: %w", req.URL.Hostname(), err)
+	}
+	if !t.filter.accepts(p) {
+		return nil, fmt.Errorf("peer %s is not accepted by the peer filter", p)
+	}
+	return t.inner.RoundTrip(req)
+}
+
+// peerFilterKeyDB hides the keys of servers that the filter doesn't accept,
+// and refuses to store them, so that nothing they signed is trusted. Keys
+// that were stored before a peer was denied are treated as if they were
+// gone, and come back if the peer is accepted again.
+type peerFilterKeyDB struct {
+	keydb.Database
+	self   gomatrixserverlib.ServerName // our own keys are always kept
+	filter *peerFilter
+	names  *nameService
+}
+
+func (d *peerFilterKeyDB) accepts(serverName gomatrixserverlib.ServerName) bool {
+	return serverName == d.self || d.filter.acceptsServer(serverName, d.names)
+}
+
+// Close closes the wrapped database, if it can be closed.
+func (d *peerFilterKeyDB) Close() error {
+	if closer, ok := d.Database.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func (d *peerFilterKeyDB) FetchKeys(
+	ctx context.Context,
+	requests map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
+) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, error) {
+	accepted := make(map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp, len(requests))
+	for req, ts := range requests {
+		if d.accepts(req.ServerName) {
+			accepted[req] = ts
+		}
+	}
+	return d.Database.FetchKeys(ctx, accepted)
+}
+
+func (d *peerFilterKeyDB) StoreKeys(
+	ctx context.Context,
+	keys map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult,
+) error {
+	accepted := make(map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, len(keys))
+	for req, key := range keys {
+		if d.accepts(req.ServerName) {
+			accepted[req] = key
+		}
+	}
+	return d.Database.StoreKeys(ctx, accepted)
+}
+
+// AllowPeer always accepts the peer from now on, even if we only accept
+// allowed peers.
+func (s *Server) AllowPeer(peerID string) error {
+	return s.setPeerRule(peerID, PeerRuleAllow)
+}
+
+// DenyPeer never accepts the peer from now on, and disconnects from it. Keys
+// that we already have for it are no longer used.
+func (s *Server) DenyPeer(peerID string) error {
+	return s.setPeerRule(peerID, PeerRuleDeny)
+}
+
+// UnlistPeer removes the peer from the filter, so that it is treated like any
+// other peer.
+func (s *Server) UnlistPeer(peerID string) error {
+	return s.setPeerRule(peerID, PeerRuleNone)
+}
+
+// PeerRule returns PeerRuleAllow or PeerRuleDeny if the peer is in the filter,
+// or PeerRuleNone if it isn't.
+func (s *Server) PeerRule(peerID string) (string, error) {
+	p, err := peer.IDB58Decode(peerID)
+	if err != nil {
+		return "", fmt.Errorf("invalid peer ID: %w", err)
+	}
+	return s.filter.rule(p), nil
+}
+
+func (s *Server) setPeerRule(peerID string, rule string) error {
+	p, err := peer.IDB58Decode(peerID)
+	if err != nil {
+		return fmt.Errorf("invalid peer ID: %w", err)
+	}
+	if err = s.filter.setRule(s.p2p.LibP2PContext, p, rule); err != nil {
+		return fmt.Errorf("failed to store peer rule: %w", err)
+	}
+	if !s.filter.accepts(p) {
+		return s.p2p.LibP2P.Network().ClosePeer(p)
+	}
+	return nil
+}
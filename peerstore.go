@@ -0,0 +1,232 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/lihram/server/v2/internal/sqlutil"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/peer"
+	pstore "github.com/libp2p/go-libp2p-core/peerstore"
+	"github.com/matrix-org/gomatrixserverlib"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/sirupsen/logrus"
+
+	// Import the sqlite3 database driver.
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// PeerstoreInterval is how often we save the addresses of the peers that we
+// are connected to.
+const PeerstoreInterval = time.Minute
+
+const peerstoreSchema = `
+-- Stores the peers that we have been connected to.
+CREATE TABLE IF NOT EXISTS p2p_peers (
+    peer_id TEXT NOT NULL PRIMARY KEY,
+    -- The public key of the peer, as marshalled by libp2p.
+    public_key BLOB NOT NULL,
+    -- When we were last connected to the peer.
+    last_seen_ts BIGINT NOT NULL
+);
+
+-- Stores the addresses of the peers that we have been connected to.
+CREATE TABLE IF NOT EXISTS p2p_peer_addrs (
+    peer_id TEXT NOT NULL,
+    addr TEXT NOT NULL,
+    -- When the peer last had this address.
+    last_seen_ts BIGINT NOT NULL,
+    UNIQUE (peer_id, addr)
+);
+`
+
+const upsertPeerSQL = "" +
+	"INSERT INTO p2p_peers (peer_id, public_key, last_seen_ts) VALUES ($1, $2, $3)" +
+	" ON CONFLICT (peer_id) DO UPDATE SET public_key = $2, last_seen_ts = $3"
+
+const upsertPeerAddrSQL = "" +
+	"INSERT INTO p2p_peer_addrs (peer_id, addr, last_seen_ts) VALUES ($1, $2, $3)" +
+	" ON CONFLICT (peer_id, addr) DO UPDATE SET last_seen_ts = $3"
+
+const selectRecentPeersSQL = "" +
+	"SELECT p.peer_id, p.public_key, a.addr FROM p2p_peers p" +
+	" JOIN p2p_peer_addrs a ON p.peer_id = a.peer_id" +
+	" WHERE a.last_seen_ts >= $1"
+
+const deleteExpiredPeersSQL = "" +
+	"DELETE FROM p2p_peers WHERE last_seen_ts < $1"
+
+const deleteExpiredPeerAddrsSQL = "" +
+	"DELETE FROM p2p_peer_addrs WHERE last_seen_ts < $1"
+
+// peerStore remembers the peers that we have been connected to, so that we can
+// reconnect to them straight away when we restart instead of waiting for them
+// to be discovered again.
+type peerStore struct {
+	db                         *sql.DB
+	host                       host.Host
+	expiry                     time.Duration
+	upsertPeerStmt             *sql.Stmt
+	upsertPeerAddrStmt         *sql.Stmt
+	selectRecentPeersStmt      *sql.Stmt
+	deleteExpiredPeersStmt     *sql.Stmt
+	deleteExpiredPeerAddrsStmt *sql.Stmt
+}
+
+func newPeerStore(dataSourceName string, h host.Host, expiry time.Duration) (*peerStore, error) {
+	s := &peerStore{
+		host:   h,
+		expiry: expiry,
+	}
+	var err error
+	s.db, err = sqlutil.Open("sqlite3", dataSourceName, peerstoreSchema, []sqlutil.Statement{
+		{Stmt: &s.upsertPeerStmt, SQL: upsertPeerSQL},
+		{Stmt: &s.upsertPeerAddrStmt, SQL: upsertPeerAddrSQL},
+		{Stmt: &s.selectRecentPeersStmt, SQL: selectRecentPeersSQL},
+		{Stmt: &s.deleteExpiredPeersStmt, SQL: deleteExpiredPeersSQL},
+		{Stmt: &s.deleteExpiredPeerAddrsStmt, SQL: deleteExpiredPeerAddrsSQL},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// start implements peerDiscovery. It redials the peers that we have seen
+// recently, and then saves the peers that we are connected to every
+// PeerstoreInterval.
+func (s *peerStore) start(ctx context.Context, notifee *peerNotifee) error {
+	peers, err := s.recentPeers(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to load peerstore: %w", err)
+	}
+	notifee = notifee.withSource("peerstore")
+	go func() {
+		for _, p := range peers {
+			notifee.HandlePeerFound(p)
+		}
+	}()
+	go func() {
+		ticker := time.NewTicker(PeerstoreInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				s.save(ctx)
+			}
+		}
+	}()
+	return nil
+}
+
+// recentPeers removes the peers that have expired and returns the rest,
+// after adding their keys and addresses to the libp2p peerstore.
+func (s *peerStore) recentPeers(ctx context.Context) ([]peer.AddrInfo, error) {
+	cutoff := gomatrixserverlib.AsTimestamp(time.Now().Add(-s.expiry))
+	if _, err := s.deleteExpiredPeerAddrsStmt.ExecContext(ctx, cutoff); err != nil {
+		return nil, err
+	}
+	if _, err := s.deleteExpiredPeersStmt.ExecContext(ctx, cutoff); err != nil {
+		return nil, err
+	}
+
+	rows, err := s.selectRecentPeersStmt.QueryContext(ctx, cutoff)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close() // nolint: errcheck
+
+	infos := make(map[peer.ID]*peer.AddrInfo)
+	for rows.Next() {
+		var peerID, addr string
+		var publicKey []byte
+		if err = rows.Scan(&peerID, &publicKey, &addr); err != nil {
+			return nil, err
+		}
+		p, err := peer.IDB58Decode(peerID)
+		if err != nil {
+			continue
+		}
+		maddr, err := ma.NewMultiaddr(addr)
+		if err != nil {
+			continue
+		}
+		info, ok := infos[p]
+		if !ok {
+			pubKey, err := crypto.UnmarshalPublicKey(publicKey)
+			if err != nil || s.host.Peerstore().AddPubKey(p, pubKey) != nil {
+				continue
+			}
+			info = &peer.AddrInfo{ID: p}
+			infos[p] = info
+		}
+		info.Addrs = append(info.Addrs, maddr)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	peers := make([]peer.AddrInfo, 0, len(infos))
+	for _, info := range infos {
+		s.host.Peerstore().AddAddrs(info.ID, info.Addrs, pstore.RecentlyConnectedAddrTTL)
+		peers = append(peers, *info)
+	}
+	return peers, nil
+}
+
+// save stores the keys and addresses of the peers that we are connected to.
+func (s *peerStore) save(ctx context.Context) {
+	now := gomatrixserverlib.AsTimestamp(time.Now())
+	for _, p := range s.host.Network().Peers() {
+		if err := s.savePeer(ctx, p, now); err != nil {
+			logrus.WithError(err).Warn("Failed to save peer ", p)
+		}
+	}
+}
+
+func (s *peerStore) savePeer(ctx context.Context, p peer.ID, now gomatrixserverlib.Timestamp) error {
+	pubKey := s.host.Peerstore().PubKey(p)
+	if pubKey == nil {
+		return fmt.Errorf("no public key")
+	}
+	publicKey, err := crypto.MarshalPublicKey(pubKey)
+	if err != nil {
+		return err
+	}
+	if _, err = s.upsertPeerStmt.ExecContext(ctx, p.String(), publicKey, now); err != nil {
+		return err
+	}
+	for _, addr := range s.host.Peerstore().Addrs(p) {
+		if _, err = s.upsertPeerAddrStmt.ExecContext(ctx, p.String(), addr.String(), now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// close saves the peers that we are connected to one last time and closes
+// the database.
+func (s *peerStore) close() error {
+	s.save(context.Background())
+	return s.db.Close()
+}
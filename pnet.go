@@ -0,0 +1,78 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/libp2p/go-libp2p-core/pnet"
+)
+
+// SwarmKeyFile is the name of the file in the instance path that the
+// pre-shared key of a private network is read from, if it isn't in the
+// config. It uses the same format as IPFS swarm keys.
+const SwarmKeyFile = "swarm.key"
+
+// privateNetworkKey returns the pre-shared key of the private network that
+// we are in, or nil if we aren't in one.
+func (c *Config) privateNetworkKey() (pnet.PSK, error) {
+	if !c.PrivateNetwork {
+		return nil, nil
+	}
+	if c.PrivateNetworkKey != "" {
+		return decodePSK(c.PrivateNetworkKey)
+	}
+	filename := filepath.Join(c.Path, SwarmKeyFile)
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read private network key: %w", err)
+	}
+	defer f.Close() // nolint: errcheck
+	psk, err := pnet.DecodeV1PSK(f)
+	if err != nil {
+		return nil, fmt.Errorf("invalid swarm key file: %w", err)
+	}
+	return psk, nil
+}
+
+// decodePSK decodes a pre-shared key given as 64 hex digits.
+func decodePSK(key string) (pnet.PSK, error) {
+	psk, err := hex.DecodeString(strings.TrimSpace(key))
+	if err != nil {
+		return nil, fmt.Errorf("invalid private network key: %w", err)
+	}
+	if len(psk) != 32 {
+		return nil, fmt.Errorf("private network key must be 32 bytes, not %d", len(psk))
+	}
+	return pnet.PSK(psk), nil
+}
+
+// networkNamespace returns a name for the private network, which is added to
+// the mDNS service tag, DHT protocol and pubsub topics so that nodes in
+// different networks never try to talk to each other. It is derived from the
+// key, so that nodes in the same network agree on it without revealing the
+// key. It is empty if we aren't in a private network.
+func networkNamespace(psk pnet.PSK) string {
+	if psk == nil {
+		return ""
+	}
+	sum := sha256.Sum256(append([]byte("matrix-dendrite-p2p-network:"), psk...))
+	return hex.EncodeToString(sum[:8])
+}
@@ -15,24 +15,25 @@
 package server
 
 import (
+	"context"
 	"crypto/ed25519"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"net"
 	"net/http"
-	"os"
+	"sync"
 	"time"
 
 	"github.com/lihram/server/v2/storage"
+	"github.com/lihram/server/v2/storage/directory"
 
+	"github.com/libp2p/go-libp2p-core/peer"
 	gostream "github.com/libp2p/go-libp2p-gostream"
 	p2phttp "github.com/libp2p/go-libp2p-http"
-	p2pdisc "github.com/libp2p/go-libp2p/p2p/discovery"
 	"github.com/matrix-org/dendrite/appservice"
 	"github.com/matrix-org/dendrite/clientapi"
 	"github.com/matrix-org/dendrite/clientapi/producers"
 	"github.com/matrix-org/dendrite/common"
-	"github.com/matrix-org/dendrite/common/config"
 	"github.com/matrix-org/dendrite/common/keydb"
 	"github.com/matrix-org/dendrite/common/transactions"
 	"github.com/matrix-org/dendrite/eduserver"
@@ -40,6 +41,7 @@ import (
 	"github.com/matrix-org/dendrite/federationsender"
 	"github.com/matrix-org/dendrite/mediaapi"
 	"github.com/matrix-org/dendrite/publicroomsapi"
+	publicroomsstorage "github.com/matrix-org/dendrite/publicroomsapi/storage"
 	"github.com/matrix-org/dendrite/roomserver"
 	"github.com/matrix-org/dendrite/syncapi"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -51,8 +53,9 @@ import (
 )
 
 func createKeyDB(
-	p2p *p2pDendrite,
-) keydb.Database {
+	p2p *p2pDendrite, filter *peerFilter, names *nameService,
+	oldKeys map[gomatrixserverlib.KeyID]gomatrixserverlib.OldVerifyKey,
+) (keydb.Database, error) {
 	db, err := keydb.NewDatabase(
 		string(p2p.Base.Cfg.Database.ServerKey),
 		p2p.Base.Cfg.DbProperties(),
@@ -61,34 +64,52 @@ func createKeyDB(
 		p2p.Base.Cfg.Matrix.KeyID,
 	)
 	if err != nil {
-		logrus.WithError(err).Panicf("failed to connect to keys db")
+		return nil, fmt.Errorf("failed to connect to keys db: %w", err)
 	}
-	mdns := mDNSListener{
-		host:  p2p.LibP2P,
-		keydb: db,
+	db = &peerFilterKeyDB{
+		Database: db,
+		self:     p2p.Base.Cfg.Matrix.ServerName,
+		filter:   filter,
+		names:    names,
 	}
-	serv, err := p2pdisc.NewMdnsService(
-		p2p.LibP2PContext,
-		p2p.LibP2P,
-		time.Second*10,
-		"_matrix-dendrite-p2p._tcp",
-	)
-	if err != nil {
-		panic(err)
+	// Keep the keys that we used to sign with, so that what we signed with
+	// them can still be verified.
+	keys := map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{}
+	for keyID, oldKey := range oldKeys {
+		keys[gomatrixserverlib.PublicKeyLookupRequest{
+			ServerName: p2p.Base.Cfg.Matrix.ServerName,
+			KeyID:      keyID,
+		}] = gomatrixserverlib.PublicKeyLookupResult{
+			VerifyKey:    oldKey.VerifyKey,
+			ValidUntilTS: oldKey.ExpiredTS,
+			ExpiredTS:    oldKey.ExpiredTS,
+		}
 	}
-	serv.RegisterNotifee(&mdns)
-	return db
+	if err = db.StoreKeys(context.Background(), keys); err != nil {
+		return nil, fmt.Errorf("failed to store old keys: %w", err)
+	}
+	newKeyExchange(p2p, db, filter, names, oldKeys)
+	return db, nil
 }
 
 func createFederationClient(
-	p2p *p2pDendrite,
+	p2p *p2pDendrite, filter *peerFilter, names *nameService, https http.RoundTripper, gateway peer.ID,
 ) *gomatrixserverlib.FederationClient {
-	fmt.Println("Running in libp2p federation mode")
-	fmt.Println("Warning: Federation with non-libp2p homeservers will not work in this mode yet!")
+	fmt.Println("Running in hybrid federation mode")
 	tr := &http.Transport{}
 	tr.RegisterProtocol(
 		"matrix",
-		p2phttp.NewTransport(p2p.LibP2P, p2phttp.ProtocolOption("/matrix")),
+		&routingTransport{
+			p2p: &nameResolvingTransport{
+				names: names,
+				inner: &peerFilterTransport{
+					filter: filter,
+					inner:  p2phttp.NewTransport(p2p.LibP2P, p2phttp.ProtocolOption("/matrix")),
+				},
+			},
+			https:   https,
+			gateway: gateway,
+		},
 	)
 	return gomatrixserverlib.NewFederationClientWithTransport(
 		p2p.Base.Cfg.Matrix.ServerName, p2p.Base.Cfg.Matrix.KeyID, p2p.Base.Cfg.Matrix.PrivateKey, tr,
@@ -100,56 +121,178 @@ type Callback interface {
 	SetPort(int)
 }
 
-// Init starts the Dendrite server in p2p mode
-func Init(path string, instanceName string, instancePort int, callback Callback) {
-	filename := fmt.Sprintf("%s/%s-private.key", path, instanceName)
-	_, err := os.Stat(filename)
-	var privKey ed25519.PrivateKey
-	if os.IsNotExist(err) {
-		_, privKey, _ = ed25519.GenerateKey(nil)
-		if err = ioutil.WriteFile(filename, privKey, 0600); err != nil {
-			fmt.Printf("Couldn't write private key to file '%s': %s\n", filename, err)
+// ErrorCallback can optionally be implemented by a Callback to be told about
+// errors that happen after Start has returned, e.g. a listener failing.
+type ErrorCallback interface {
+	OnError(message string)
+}
+
+// Server is a handle to a running Dendrite P2P instance, as returned by
+// Start. Call Stop to shut it down.
+type Server struct {
+	p2p           *p2pDendrite
+	publicRoomsDB publicroomsstorage.Database
+	callback      Callback
+	events        *eventNotifier
+	filter        *peerFilter
+	names         *nameService
+	peerStore     *peerStore
+	httpServer    *http.Server
+	libp2pServer  *http.Server
+	port          int           // the port of the HTTP listener
+	metrics       *p2pCollector // metrics of the libp2p host
+	closers       []namedCloser // closed by Stop in reverse order
+	unregisters   []func() bool // unregister the metrics of this server
+	metricsMutex  sync.Mutex    // protects unregisters
+	stopOnce      sync.Once
+}
+
+// namedCloser is something that Stop closes, with a name for logging.
+type namedCloser struct {
+	name  string
+	close func() error
+}
+
+// closeOnStop makes Stop close something that was opened by StartWithConfig.
+// Everything is closed in the reverse of the order that it was opened in.
+func (s *Server) closeOnStop(name string, close func() error) {
+	s.closers = append(s.closers, namedCloser{name: name, close: close})
+}
+
+// closeOnStopIfCloser makes Stop close v if it has a Close method. Not every
+// Dendrite database has one.
+func (s *Server) closeOnStopIfCloser(name string, v interface{}) {
+	if closer, ok := v.(io.Closer); ok {
+		s.closeOnStop(name, closer.Close)
+	}
+}
+
+// Init starts the Dendrite server in p2p mode and blocks forever. It only
+// returns if the server fails to start.
+func Init(path string, instanceName string, instancePort int, callback Callback) error {
+	if _, err := Start(path, instanceName, instancePort, callback); err != nil {
+		return err
+	}
+
+	// We want to block forever to let the HTTP and HTTPS handler serve the APIs
+	select {}
+}
+
+// Start starts the Dendrite server in p2p mode with the default configuration
+// and returns once the APIs are being served. The returned Server must be
+// stopped with Stop. Several servers can run in one process as long as they
+// have different paths or instance names.
+func Start(path string, instanceName string, instancePort int, callback Callback) (*Server, error) {
+	cfg := NewConfig(path, instanceName)
+	cfg.ListenAddress = fmt.Sprintf(":%d", instancePort)
+	return StartWithConfig(cfg, callback)
+}
+
+// StartWithConfig starts the Dendrite server in p2p mode and returns once the
+// APIs are being served. The returned Server must be stopped with Stop. The
+// callback may be nil.
+func StartWithConfig(p2pCfg *Config, callback Callback) (_ *Server, err error) {
+	if err = p2pCfg.verify(); err != nil {
+		return nil, err
+	}
+
+	// The Dendrite components panic when they fail to start, e.g. because a
+	// database can't be opened. Turn that into an error for the caller, and
+	// tear down whatever we managed to start.
+	var s *Server
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("failed to start Dendrite: %v", r)
 		}
-	} else {
-		privKey, err = ioutil.ReadFile(filename)
-		if err != nil {
-			fmt.Printf("Couldn't read private key from file '%s': %s\n", filename, err)
-			_, privKey, _ = ed25519.GenerateKey(nil)
+		if err != nil && s != nil {
+			s.Stop()
 		}
+	}()
+
+	id, err := p2pCfg.loadIdentity()
+	if err != nil {
+		return nil, err
 	}
 
-	cfg := config.Dendrite{}
-	cfg.Matrix.ServerName = "p2p"
-	cfg.Matrix.PrivateKey = privKey
-	cfg.Matrix.KeyID = gomatrixserverlib.KeyID(fmt.Sprintf("ed25519:%s", instanceName))
-	cfg.Kafka.UseNaffka = true
-	cfg.Kafka.Topics.OutputRoomEvent = "roomserverOutput"
-	cfg.Kafka.Topics.OutputClientData = "clientapiOutput"
-	cfg.Kafka.Topics.OutputTypingEvent = "typingServerOutput"
-	cfg.Kafka.Topics.UserUpdates = "userUpdates"
-	cfg.Database.Account = config.DataSource(fmt.Sprintf("file:%s/%s-account.db", path, instanceName))
-	cfg.Database.Device = config.DataSource(fmt.Sprintf("file:%s/%s-device.db", path, instanceName))
-	cfg.Database.MediaAPI = config.DataSource(fmt.Sprintf("file:%s/%s-mediaapi.db", path, instanceName))
-	cfg.Database.SyncAPI = config.DataSource(fmt.Sprintf("file:%s/%s-syncapi.db", path, instanceName))
-	cfg.Database.RoomServer = config.DataSource(fmt.Sprintf("file:%s/%s-roomserver.db", path, instanceName))
-	cfg.Database.ServerKey = config.DataSource(fmt.Sprintf("file:%s/%s-serverkey.db", path, instanceName))
-	cfg.Database.FederationSender = config.DataSource(fmt.Sprintf("file:%s/%s-federationsender.db", path, instanceName))
-	cfg.Database.AppService = config.DataSource(fmt.Sprintf("file:%s/%s-appservice.db", path, instanceName))
-	cfg.Database.PublicRoomsAPI = config.DataSource(fmt.Sprintf("file:%s/%s-publicroomsa.db", path, instanceName))
-	cfg.Database.Naffka = config.DataSource(fmt.Sprintf("file:%s/%s-naffka.db", path, instanceName))
-	if err = cfg.Derive(); err != nil {
-		panic(err)
-	}
-
-	p2p := newP2PDendrite(&cfg, "Monolith")
-	defer p2p.Base.Close() // nolint: errcheck
+	cfg, err := p2pCfg.dendriteConfig(id.currentSigningKey())
+	if err != nil {
+		return nil, err
+	}
+
+	p2p, err := newP2PDendrite(cfg, p2pCfg, id.PrivateKey, "Monolith")
+	if err != nil {
+		return nil, err
+	}
+	s = &Server{
+		p2p:          p2p,
+		callback:     callback,
+		events:       newEventNotifier(callback),
+		httpServer:   &http.Server{},
+		libp2pServer: &http.Server{},
+		metrics:      &p2pCollector{p2p: p2p, peersDiscovered: newPeersDiscovered()},
+	}
+	s.closeOnStop("Kafka producer", p2p.Base.KafkaProducer.Close)
+	s.closeOnStop("Kafka consumer", p2p.Base.KafkaConsumer.Close)
+
+	s.filter, err = newPeerFilter(string(p2pCfg.dataSource(p2pCfg.PeerFilterDatabase, "peerfilter")), p2pCfg.AllowlistOnly, callback)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open peer filter: %w", err)
+	}
+	s.closeOnStop("peer filter", s.filter.close)
+	p2p.LibP2P.Network().Notify(&s.filter.notifiee)
+	p2p.LibP2P.Network().Notify(&s.events.notifiee)
+	go s.events.run(p2p.LibP2PContext)
 
 	accountDB := p2p.Base.CreateAccountsDB()
+	s.closeOnStopIfCloser("account database", accountDB)
 	deviceDB := p2p.Base.CreateDeviceDB()
-	keyDB := createKeyDB(p2p)
-	federation := createFederationClient(p2p)
+	s.closeOnStopIfCloser("device database", deviceDB)
+	nameTopic := NamePubSubTopic
+	if p2p.LibP2PNamespace != "" {
+		nameTopic += "/" + p2p.LibP2PNamespace
+	}
+	var ourName string
+	if p2pCfg.ServerName != "" {
+		ourName = string(cfg.Matrix.ServerName)
+	}
+	if s.names, err = newNameService(p2p, ourName, nameTopic); err != nil {
+		return nil, fmt.Errorf("failed to start name service: %w", err)
+	}
+	s.names.start(p2p.LibP2PContext)
+
+	keyDB, err := createKeyDB(p2p, s.filter, s.names, id.oldVerifyKeys())
+	if err != nil {
+		return nil, err
+	}
+	s.closeOnStopIfCloser("keys database", keyDB)
+	var backends []peerDiscovery
+	if p2pCfg.PeerstoreEnabled {
+		dataSource := p2pCfg.dataSource(p2pCfg.PeerstoreDatabase, "peerstore")
+		expiry := time.Hour * time.Duration(p2pCfg.PeerstoreExpiry)
+		if s.peerStore, err = newPeerStore(string(dataSource), p2p.LibP2P, expiry); err != nil {
+			return nil, fmt.Errorf("failed to open peerstore: %w", err)
+		}
+		s.closeOnStop("peerstore", s.peerStore.close)
+		backends = append(backends, s.peerStore)
+	}
+	if err = startDiscovery(p2p, p2pCfg, s.filter, s.metrics.peersDiscovered, backends...); err != nil {
+		return nil, err
+	}
+	var gateway peer.ID
+	if p2pCfg.FederationGatewayPeer != "" {
+		if gateway, err = peer.IDB58Decode(p2pCfg.FederationGatewayPeer); err != nil {
+			return nil, fmt.Errorf("invalid federation gateway peer: %w", err)
+		}
+	}
+	https := newHTTPSTransport()
+	federation := createFederationClient(p2p, s.filter, s.names, https, gateway)
 	keyRing := keydb.CreateKeyRing(federation.Client, keyDB, cfg.Matrix.KeyPerspectives)
 
+	// The components register their metrics with the default registerer.
+	// Label them with our server name, so that they don't clash with the
+	// metrics of other servers in the process.
+	restoreRegisterer := s.useServerRegisterer()
+	defer restoreRegisterer()
 	rsAPI := roomserver.SetupRoomServerComponent(
 		&p2p.Base, keyRing, federation,
 	)
@@ -172,46 +315,162 @@ func Init(path string, instanceName string, instancePort int, callback Callback)
 	eduProducer := producers.NewEDUServerProducer(eduInputAPI)
 	federationapi.SetupFederationAPIComponent(&p2p.Base, accountDB, deviceDB, federation, &keyRing, rsAPI, asAPI, fsAPI, eduProducer)
 	mediaapi.SetupMediaAPIComponent(&p2p.Base, deviceDB)
-	publicRoomsDB, err := storage.NewPublicRoomsServerDatabaseWithPubSub(string(p2p.Base.Cfg.Database.PublicRoomsAPI), p2p.LibP2PPubsub)
+	var publicRoomsDB publicroomsstorage.Database
+	discoveredRoomTTL := time.Second * time.Duration(p2pCfg.DiscoveredRoomTTL)
+	tableDataSource := string(p2pCfg.dataSource(p2pCfg.DiscoveredRoomsDatabase, "discoveredrooms"))
+	switch p2pCfg.PublicRoomsBackend {
+	case PublicRoomsBackendDHT:
+		privKey := p2p.LibP2P.Peerstore().PrivKey(p2p.LibP2P.ID())
+		publicRoomsDB, err = storage.NewPublicRoomsServerDatabaseWithDHT(string(p2p.Base.Cfg.Database.PublicRoomsAPI), tableDataSource, p2p.LibP2PDHT, privKey, s.names.owns, discoveredRoomTTL)
+	default:
+		topic := directory.PubSubTopic
+		if p2p.LibP2PNamespace != "" {
+			topic += "/" + p2p.LibP2PNamespace
+		}
+		publicRoomsDB, err = storage.NewPublicRoomsServerDatabaseWithPubSub(string(p2p.Base.Cfg.Database.PublicRoomsAPI), tableDataSource, p2p.LibP2PPubsub, p2p.LibP2P.ID(), topic, s.names.owns, discoveredRoomTTL)
+	}
 	if err != nil {
-		logrus.WithError(err).Panicf("failed to connect to public rooms db")
+		return nil, fmt.Errorf("failed to connect to public rooms db: %w", err)
+	}
+	s.publicRoomsDB = publicRoomsDB
+	if db, ok := publicRoomsDB.(interface{ Stop() }); ok {
+		s.closeOnStop("public rooms database", func() error {
+			db.Stop()
+			return nil
+		})
 	}
 	publicroomsapi.SetupPublicRoomsAPIComponent(&p2p.Base, deviceDB, publicRoomsDB, rsAPI, federation, nil) // Check this later
-	syncapi.SetupSyncAPIComponent(&p2p.Base, deviceDB, accountDB, rsAPI, federation, &cfg)
+	syncapi.SetupSyncAPIComponent(&p2p.Base, deviceDB, accountDB, rsAPI, federation, cfg)
+	restoreRegisterer()
 
-	httpHandler := common.WrapHandlerInCORS(p2p.Base.APIMux)
+	// Set up the API endpoints we handle on the HTTP listener. /metrics is for
+	// prometheus, and is not wrapped by CORS, while everything else is. Each
+	// listener gets its own mux rather than http.DefaultServeMux, so that
+	// nothing else in the app can collide with our routes.
+	if err = s.registerMetrics(); err != nil {
+		return nil, fmt.Errorf("failed to register metrics: %w", err)
+	}
+	clientMux := http.NewServeMux()
+	clientMux.Handle("/metrics", promhttp.Handler())
+	clientMux.Handle(AdminPathPrefix, s.adminHandler(p2pCfg.AdminToken))
+	clientMux.Handle("/", common.WrapHandlerInCORS(p2p.Base.APIMux))
+	s.httpServer.Handler = clientMux
 
-	// Set up the API endpoints we handle. /metrics is for prometheus, and is
-	// not wrapped by CORS, while everything else is
-	http.Handle("/metrics", promhttp.Handler())
-	http.Handle("/", httpHandler)
+	// Other peers only get the server-server APIs over libp2p. Media downloads
+	// and thumbnails are included because remote servers fetch our media over
+	// federation, but uploads, the media config and URL previews are not.
+	libp2pMux := http.NewServeMux()
+	libp2pMux.Handle("/_matrix/federation/", p2p.Base.APIMux)
+	libp2pMux.Handle("/_matrix/key/", p2p.Base.APIMux)
+	for _, version := range []string{"r0", "v1"} {
+		libp2pMux.Handle("/_matrix/media/"+version+"/download/", p2p.Base.APIMux)
+		libp2pMux.Handle("/_matrix/media/"+version+"/thumbnail/", p2p.Base.APIMux)
+	}
+	var libp2pHandler http.Handler = libp2pMux
+	if p2pCfg.FederationGatewayEnabled {
+		// Send on requests for other homeservers if we are a gateway.
+		libp2pHandler = gatewayHandler(cfg.Matrix.ServerName, https, libp2pMux)
+	}
+	s.libp2pServer.Handler = s.filter.handler(libp2pHandler)
 
 	// Expose the matrix APIs directly rather than putting them under a /api path.
+	listener, err := net.Listen("tcp", p2pCfg.ListenAddress)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", p2pCfg.ListenAddress, err)
+	}
+	s.port = listener.Addr().(*net.TCPAddr).Port
+	if callback != nil {
+		callback.SetPort(s.port)
+	}
 	go func() {
-		httpBindAddr := fmt.Sprintf(":%d", instancePort)
-		listener, err := net.Listen("tcp", httpBindAddr)
-		if err != nil {
-			logrus.Fatal(err)
+		if err := s.httpServer.Serve(listener); err != http.ErrServerClosed {
+			s.reportError(fmt.Errorf("HTTP listener failed: %w", err))
 		}
-		instancePort = listener.Addr().(*net.TCPAddr).Port
-		callback.SetPort(instancePort)
-		logrus.Fatal(http.Serve(listener, nil))
 	}()
-	// Expose the matrix APIs also via libp2p
+	// Expose the matrix APIs also via libp2p.
 	if p2p.LibP2P != nil {
+		logrus.Info("Listening on libp2p host ID ", p2p.LibP2P.ID())
+		listener, err := gostream.Listen(p2p.LibP2P, "/matrix")
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen on libp2p: %w", err)
+		}
 		go func() {
-			logrus.Info("Listening on libp2p host ID ", p2p.LibP2P.ID())
-			listener, err := gostream.Listen(p2p.LibP2P, "/matrix")
-			if err != nil {
-				panic(err)
+			if err := s.libp2pServer.Serve(listener); err != http.ErrServerClosed {
+				s.reportError(fmt.Errorf("libp2p listener failed: %w", err))
 			}
-			defer func() {
-				logrus.Fatal(listener.Close())
-			}()
-			logrus.Fatal(http.Serve(listener, nil))
 		}()
 	}
 
-	// We want to block forever to let the HTTP and HTTPS handler serve the APIs
-	select {}
+	go s.monitor()
+	s.events.ready()
+	return s, nil
+}
+
+// PeerID returns the libp2p peer ID of the server.
+func (s *Server) PeerID() string {
+	return s.p2p.LibP2P.ID().String()
+}
+
+// ServerName returns the Matrix server name of the server, which is either
+// its peer ID or its human-friendly name.
+func (s *Server) ServerName() string {
+	return string(s.p2p.Base.Cfg.Matrix.ServerName)
+}
+
+// Port returns the port that the client API is served on.
+func (s *Server) Port() int {
+	return s.port
+}
+
+// Connect connects the server to another server in the same process, e.g.
+// when they were started with NewLoopbackConfig and so won't find each other
+// by themselves. Keys are exchanged as with any other peer.
+func (s *Server) Connect(other *Server) error {
+	info := peer.AddrInfo{
+		ID:    other.p2p.LibP2P.ID(),
+		Addrs: other.p2p.LibP2P.Addrs(),
+	}
+	ctx, cancel := context.WithTimeout(s.p2p.LibP2PContext, adminTimeout)
+	defer cancel()
+	if err := s.p2p.LibP2P.Connect(ctx, info); err != nil {
+		return fmt.Errorf("failed to connect to %s: %w", info.ID, err)
+	}
+	return nil
+}
+
+// reportError logs an error that happened after startup and passes it on to
+// the callback, if it wants to know about errors.
+func (s *Server) reportError(err error) {
+	logrus.WithError(err).Error("Dendrite P2P error")
+	if cb, ok := s.callback.(ErrorCallback); ok {
+		cb.OnError(err.Error())
+	}
+}
+
+// Stop shuts down the HTTP listeners, then closes the databases and the
+// Kafka client that were opened at startup in the reverse order, and then the
+// libp2p host and the Dendrite components. It is safe to call Stop more than
+// once.
+func (s *Server) Stop() {
+	s.stopOnce.Do(func() {
+		s.unregisterMetrics()
+		if err := s.httpServer.Close(); err != nil {
+			logrus.WithError(err).Warn("Failed to close HTTP listener")
+		}
+		if err := s.libp2pServer.Close(); err != nil {
+			logrus.WithError(err).Warn("Failed to close libp2p listener")
+		}
+		s.p2p.LibP2PCancel()
+		for i := len(s.closers) - 1; i >= 0; i-- {
+			if err := s.closers[i].close(); err != nil {
+				logrus.WithError(err).Warnf("Failed to close %s", s.closers[i].name)
+			}
+		}
+		if err := s.p2p.LibP2P.Close(); err != nil {
+			logrus.WithError(err).Warn("Failed to close libp2p host")
+		}
+		if err := s.p2p.Base.Close(); err != nil {
+			logrus.WithError(err).Warn("Failed to close Dendrite")
+		}
+	})
 }
@@ -0,0 +1,149 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/libp2p/go-libp2p-core/network"
+)
+
+// startServers starts n servers that only listen on localhost, each with a
+// path of its own. If configure isn't nil, it can change the configuration of
+// each server before it starts. The returned function stops them and removes
+// their paths.
+func startServers(t *testing.T, n int, configure func(i int, c *Config)) (servers []*Server, cleanup func()) {
+	t.Helper()
+	var paths []string
+	cleanup = func() {
+		for _, s := range servers {
+			s.Stop()
+		}
+		for _, path := range paths {
+			os.RemoveAll(path) // nolint: errcheck
+		}
+	}
+	for i := 0; i < n; i++ {
+		path, err := ioutil.TempDir("", "dendrite-p2p")
+		if err != nil {
+			cleanup()
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+		cfg := NewLoopbackConfig(path, fmt.Sprintf("node%d", i))
+		if configure != nil {
+			configure(i, cfg)
+		}
+		s, err := StartWithConfig(cfg, nil)
+		if err != nil {
+			cleanup()
+			t.Fatalf("failed to start node %d: %v", i, err)
+		}
+		servers = append(servers, s)
+	}
+	return servers, cleanup
+}
+
+// connectServers connects every pair of servers.
+func connectServers(t *testing.T, servers []*Server) {
+	t.Helper()
+	for i, s := range servers {
+		for _, other := range servers[i+1:] {
+			if err := s.Connect(other); err != nil {
+				t.Fatalf("failed to connect %s to %s: %v", s.PeerID(), other.PeerID(), err)
+			}
+		}
+	}
+}
+
+func TestServersStartConnectAndStop(t *testing.T) {
+	servers, cleanup := startServers(t, 3, nil)
+	defer cleanup()
+	connectServers(t, servers)
+
+	peerIDs := map[string]bool{}
+	for _, s := range servers {
+		if peerIDs[s.PeerID()] {
+			t.Fatalf("peer ID %s is used by more than one server", s.PeerID())
+		}
+		peerIDs[s.PeerID()] = true
+		if s.Port() == 0 {
+			t.Errorf("server %s has no HTTP port", s.ServerName())
+		}
+	}
+	for _, s := range servers {
+		for _, other := range servers {
+			if s == other {
+				continue
+			}
+			if got := s.p2p.LibP2P.Network().Connectedness(other.p2p.LibP2P.ID()); got != network.Connected {
+				t.Errorf("%s is not connected to %s: %v", s.PeerID(), other.PeerID(), got)
+			}
+		}
+	}
+
+	// Every server's metrics are registered side by side, labelled with its
+	// server name.
+	resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/metrics", servers[0].Port()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close() // nolint: errcheck
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range servers {
+		for _, metric := range []string{
+			fmt.Sprintf(`dendrite_p2p_connected_peers{server_name=%q} 2`, s.ServerName()),
+			fmt.Sprintf(`dendrite_p2p_rooms_discovered{backend="pubsub",server_name=%q}`, s.ServerName()),
+		} {
+			if !strings.Contains(string(body), metric) {
+				t.Errorf("metrics don't contain %s", metric)
+			}
+		}
+	}
+
+	for _, s := range servers {
+		s.Stop()
+		s.Stop()
+	}
+}
+
+func TestServerRestartsInSameProcess(t *testing.T) {
+	path, err := ioutil.TempDir("", "dendrite-p2p")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(path) // nolint: errcheck
+
+	var peerID string
+	for i := 0; i < 2; i++ {
+		s, err := StartWithConfig(NewLoopbackConfig(path, "node"), nil)
+		if err != nil {
+			t.Fatalf("failed to start server the %d. time: %v", i+1, err)
+		}
+		if peerID != "" && s.PeerID() != peerID {
+			t.Errorf("peer ID changed from %s to %s after restarting", peerID, s.PeerID())
+		}
+		peerID = s.PeerID()
+		s.Stop()
+	}
+}
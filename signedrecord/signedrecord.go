@@ -0,0 +1,206 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package signedrecord implements the values that we store in the DHT. Each
+// value is signed by the peer that published it and carries a sequence number
+// and an expiry time, so that nodes can reject forged or expired values and
+// pick the freshest one.
+package signedrecord
+
+import (
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	record "github.com/libp2p/go-libp2p-record"
+)
+
+// Namespace is the DHT namespace that all of our keys live in, e.g.
+// /matrix/publicRooms.
+const Namespace = "matrix"
+
+// NamesKind is the kind of key that human-friendly server names are stored
+// under, e.g. /matrix/names/alice-phone-ab3dxk7pq2mz.p2p. The value is the
+// peer ID that the name belongs to.
+const NamesKind = "names"
+
+// nameTagLength is the number of base32 digits in a name tag. It is long
+// enough that making a key whose tag matches another peer's is impractical.
+const nameTagLength = 12
+
+var nameTagEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// NameTag returns the tag that every name of the peer ends with, before the
+// top-level suffix. It is derived from the peer ID, so that a name can only
+// ever belong to one peer and nobody else can claim it.
+func NameTag(p peer.ID) string {
+	sum := sha256.Sum256([]byte(p))
+	return strings.ToLower(nameTagEncoding.EncodeToString(sum[:]))[:nameTagLength]
+}
+
+// NameBelongsTo returns whether the name, e.g. alice-phone-ab3dxk7pq2mz.p2p,
+// has the tag of the peer.
+func NameBelongsTo(name string, p peer.ID) bool {
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		name = name[:i]
+	}
+	return strings.HasSuffix(name, "-"+NameTag(p))
+}
+
+// Envelope is a signed DHT value.
+type Envelope struct {
+	// The peer that published the value and signed the envelope.
+	Publisher peer.ID `json:"publisher"`
+	// Increases every time the publisher publishes a new value.
+	Seq uint64 `json:"seq"`
+	// When the value expires, in milliseconds since the Unix epoch.
+	Expires int64 `json:"expires"`
+	// The value itself.
+	Value []byte `json:"value"`
+	// The signature of the publisher over the key and the above fields.
+	Signature []byte `json:"signature"`
+}
+
+// signedContent is what the signature in an Envelope covers. The DHT key is
+// included so that a value can't be replayed under a different key.
+type signedContent struct {
+	Key       string  `json:"key"`
+	Publisher peer.ID `json:"publisher"`
+	Seq       uint64  `json:"seq"`
+	Expires   int64   `json:"expires"`
+	Value     []byte  `json:"value"`
+}
+
+func (e *Envelope) signedBytes(key string) ([]byte, error) {
+	return json.Marshal(signedContent{
+		Key:       key,
+		Publisher: e.Publisher,
+		Seq:       e.Seq,
+		Expires:   e.Expires,
+		Value:     e.Value,
+	})
+}
+
+// Expired returns true if the value in the envelope has expired.
+func (e *Envelope) Expired() bool {
+	return time.Now().UnixNano()/int64(time.Millisecond) > e.Expires
+}
+
+// Seal wraps a value in an Envelope signed with the given key, which expires
+// after the given TTL, and returns the marshalled envelope ready to be put
+// into the DHT under the given key. The sequence number is taken from the
+// clock so that it keeps increasing across restarts.
+func Seal(privKey crypto.PrivKey, key string, value []byte, ttl time.Duration) ([]byte, error) {
+	publisher, err := peer.IDFromPrivateKey(privKey)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	e := Envelope{
+		Publisher: publisher,
+		Seq:       uint64(now.UnixNano()),
+		Expires:   now.Add(ttl).UnixNano() / int64(time.Millisecond),
+		Value:     value,
+	}
+	signed, err := e.signedBytes(key)
+	if err != nil {
+		return nil, err
+	}
+	if e.Signature, err = privKey.Sign(signed); err != nil {
+		return nil, err
+	}
+	return json.Marshal(e)
+}
+
+// Open unmarshals an Envelope that was stored in the DHT under the given key,
+// and checks that it hasn't expired and that it was signed by its publisher.
+func Open(key string, data []byte) (*Envelope, error) {
+	var e Envelope
+	if err := json.Unmarshal(data, &e); err != nil {
+		return nil, fmt.Errorf("invalid envelope: %w", err)
+	}
+	if e.Expired() {
+		return nil, errors.New("envelope has expired")
+	}
+	pubKey, err := e.Publisher.ExtractPublicKey()
+	if err != nil {
+		return nil, fmt.Errorf("can't get the public key of publisher %s: %w", e.Publisher, err)
+	}
+	signed, err := e.signedBytes(key)
+	if err != nil {
+		return nil, err
+	}
+	if ok, err := pubKey.Verify(signed, e.Signature); err != nil || !ok {
+		return nil, errors.New("invalid signature")
+	}
+	return &e, nil
+}
+
+// Validator is a libp2p record.Validator for the values in our namespace.
+type Validator struct{}
+
+// Validate checks that the key is in our namespace and that the value is a
+// valid, unexpired Envelope. Keys of the form /matrix/<kind>/<peer ID> belong
+// to that peer, so only it may publish values under them. Names can only be
+// claimed by the peer whose tag they have, and only for itself.
+func (v Validator) Validate(key string, value []byte) error {
+	ns, rest, err := record.SplitKey(key)
+	if err != nil || ns != Namespace {
+		return errors.New("not Matrix path")
+	}
+	e, err := Open(key, value)
+	if err != nil {
+		return err
+	}
+	parts := strings.SplitN(rest, "/", 2)
+	if len(parts) == 2 && parts[0] == NamesKind {
+		if string(e.Value) != e.Publisher.String() {
+			return fmt.Errorf("name %s can't be claimed by %s for another peer", parts[1], e.Publisher)
+		}
+		if !NameBelongsTo(parts[1], e.Publisher) {
+			return fmt.Errorf("name %s doesn't belong to %s", parts[1], e.Publisher)
+		}
+	} else if len(parts) == 2 {
+		if owner, err := peer.IDB58Decode(parts[1]); err == nil && owner != e.Publisher {
+			return fmt.Errorf("key belongs to %s but was published by %s", owner, e.Publisher)
+		}
+	}
+	return nil
+}
+
+// Select picks the valid Envelope with the highest sequence number, so that
+// stale and replayed values lose to newer ones.
+func (v Validator) Select(key string, vals [][]byte) (int, error) {
+	best := -1
+	var bestSeq uint64
+	for i, val := range vals {
+		e, err := Open(key, val)
+		if err != nil {
+			continue
+		}
+		if best == -1 || e.Seq > bestSeq {
+			best, bestSeq = i, e.Seq
+		}
+	}
+	if best == -1 {
+		return 0, errors.New("no valid values")
+	}
+	return best, nil
+}
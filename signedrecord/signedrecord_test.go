@@ -0,0 +1,231 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package signedrecord
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+type testPeer struct {
+	id      peer.ID
+	privKey crypto.PrivKey
+}
+
+func newTestPeer(t *testing.T) testPeer {
+	t.Helper()
+	privKey, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := peer.IDFromPrivateKey(privKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testPeer{id: id, privKey: privKey}
+}
+
+// seal is like Seal, but with a given sequence number and expiry time.
+func (p testPeer) seal(t *testing.T, key string, value []byte, seq uint64, expires time.Time) []byte {
+	t.Helper()
+	e := Envelope{
+		Publisher: p.id,
+		Seq:       seq,
+		Expires:   expires.UnixNano() / int64(time.Millisecond),
+		Value:     value,
+	}
+	signed, err := e.signedBytes(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Signature, err = p.privKey.Sign(signed); err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestValidate(t *testing.T) {
+	alice, bob := newTestPeer(t), newTestPeer(t)
+	later := time.Now().Add(time.Hour)
+	roomsKey := "/" + Namespace + "/publicRooms/" + alice.id.String()
+	aliceName := "alice-" + NameTag(alice.id) + ".p2p"
+	nameKey := "/" + Namespace + "/" + NamesKind + "/" + aliceName
+
+	// Alice's envelope, but signed by Bob.
+	var forged Envelope
+	if err := json.Unmarshal(alice.seal(t, roomsKey, []byte("rooms"), 1, later), &forged); err != nil {
+		t.Fatal(err)
+	}
+	signed, err := forged.signedBytes(roomsKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if forged.Signature, err = bob.privKey.Sign(signed); err != nil {
+		t.Fatal(err)
+	}
+	forgedData, err := json.Marshal(forged)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		key     string
+		value   []byte
+		wantErr bool
+	}{
+		{
+			name:  "valid",
+			key:   roomsKey,
+			value: alice.seal(t, roomsKey, []byte("rooms"), 1, later),
+		},
+		{
+			name:    "not our namespace",
+			key:     "/ipns/" + alice.id.String(),
+			value:   alice.seal(t, "/ipns/"+alice.id.String(), []byte("rooms"), 1, later),
+			wantErr: true,
+		},
+		{
+			name:    "not an envelope",
+			key:     roomsKey,
+			value:   []byte("rooms"),
+			wantErr: true,
+		},
+		{
+			name:    "wrong signature",
+			key:     roomsKey,
+			value:   forgedData,
+			wantErr: true,
+		},
+		{
+			name:    "wrong publisher",
+			key:     roomsKey,
+			value:   bob.seal(t, roomsKey, []byte("rooms"), 1, later),
+			wantErr: true,
+		},
+		{
+			name:    "expired",
+			key:     roomsKey,
+			value:   alice.seal(t, roomsKey, []byte("rooms"), 1, time.Now().Add(-time.Minute)),
+			wantErr: true,
+		},
+		{
+			name:    "value reused under another key",
+			key:     "/" + Namespace + "/publicRooms/" + bob.id.String(),
+			value:   alice.seal(t, roomsKey, []byte("rooms"), 1, later),
+			wantErr: true,
+		},
+		{
+			name:  "own name",
+			key:   nameKey,
+			value: alice.seal(t, nameKey, []byte(alice.id.String()), 1, later),
+		},
+		{
+			name:    "name of another peer",
+			key:     nameKey,
+			value:   bob.seal(t, nameKey, []byte(bob.id.String()), 1, later),
+			wantErr: true,
+		},
+		{
+			name:    "name claimed for another peer",
+			key:     nameKey,
+			value:   alice.seal(t, nameKey, []byte(bob.id.String()), 1, later),
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := Validator{}.Validate(test.key, test.value)
+			if test.wantErr && err == nil {
+				t.Error("expected an error")
+			} else if !test.wantErr && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestSelect(t *testing.T) {
+	alice := newTestPeer(t)
+	later := time.Now().Add(time.Hour)
+	key := "/" + Namespace + "/publicRooms/" + alice.id.String()
+	older := alice.seal(t, key, []byte("older"), 1, later)
+	newer := alice.seal(t, key, []byte("newer"), 2, later)
+	expired := alice.seal(t, key, []byte("expired"), 3, time.Now().Add(-time.Minute))
+	otherKey := alice.seal(t, key+"x", []byte("other key"), 4, later)
+
+	tests := []struct {
+		name    string
+		vals    [][]byte
+		want    int
+		wantErr bool
+	}{
+		{name: "newer after older", vals: [][]byte{older, newer}, want: 1},
+		{name: "newer before older", vals: [][]byte{newer, older}, want: 0},
+		{name: "expired is skipped", vals: [][]byte{older, expired}, want: 0},
+		{name: "other key is skipped", vals: [][]byte{otherKey, older}, want: 1},
+		{name: "nothing valid", vals: [][]byte{expired, otherKey}, wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := Validator{}.Select(key, test.vals)
+			if test.wantErr {
+				if err == nil {
+					t.Error("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != test.want {
+				t.Errorf("got %d, want %d", got, test.want)
+			}
+		})
+	}
+}
+
+func TestNameBelongsTo(t *testing.T) {
+	alice, bob := newTestPeer(t), newTestPeer(t)
+	tag := NameTag(alice.id)
+	if len(tag) != nameTagLength {
+		t.Fatalf("tag %q has %d digits, want %d", tag, len(tag), nameTagLength)
+	}
+	tests := []struct {
+		name string
+		p    peer.ID
+		want bool
+	}{
+		{name: "alice-" + tag + ".p2p", p: alice.id, want: true},
+		{name: "alice-phone-" + tag + ".p2p", p: alice.id, want: true},
+		{name: "alice-" + tag + ".p2p", p: bob.id, want: false},
+		{name: "alice" + tag + ".p2p", p: alice.id, want: false},
+		{name: "alice.p2p", p: alice.id, want: false},
+	}
+	for _, test := range tests {
+		if got := NameBelongsTo(test.name, test.p); got != test.want {
+			t.Errorf("NameBelongsTo(%q, %s) = %v, want %v", test.name, test.p, got, test.want)
+		}
+	}
+}
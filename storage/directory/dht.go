@@ -0,0 +1,227 @@
+// Copyright 2019-2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package directory
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/lihram/server/v2/signedrecord"
+
+	cid "github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/matrix-org/gomatrixserverlib"
+	multihash "github.com/multiformats/go-multihash"
+)
+
+// DHTRecordTTL is how long the rooms that we put into the DHT remain valid
+// for if we stop refreshing them.
+const DHTRecordTTL = MaintenanceInterval * 6
+
+// DHTSearchTimeout is how long we spend looking for nodes with rooms in the
+// DHT, and DHTFetchTimeout is how long we spend fetching the rooms of each.
+const (
+	DHTSearchTimeout = time.Second * 10
+	DHTFetchTimeout  = time.Second * 10
+)
+
+// DHTProvideInterval is how often we provide the directory CID again. Provider
+// records last for a day, and providing walks the DHT, so there is no need
+// to do it every time that we advertise.
+const DHTProvideInterval = time.Hour * 12
+
+// dhtFetchConcurrency is how many nodes we fetch rooms from at once.
+const dhtFetchConcurrency = 16
+
+// dhtKeyPrefix is the prefix of the DHT keys that public rooms are stored
+// under. Each node stores its own rooms under the prefix followed by its
+// peer ID, so that nodes don't overwrite each other.
+const dhtKeyPrefix = "/matrix/publicRooms/"
+
+// maxDirectoryProviders is the most nodes that we fetch rooms from.
+const maxDirectoryProviders = 1024
+
+// directoryCID is the well-known CID that every node with public rooms in the
+// DHT provides, so that the other nodes can find them.
+var directoryCID cid.Cid
+
+func init() {
+	hash, err := multihash.Sum([]byte("/matrix/publicRooms"), multihash.SHA2_256, -1)
+	if err != nil {
+		panic(err)
+	}
+	directoryCID = cid.NewCidV1(cid.Raw, hash)
+}
+
+// DHTTransport puts our public rooms into the DHT, and fetches the rooms that
+// other nodes have put there.
+type DHTTransport struct {
+	dht          *dht.IpfsDHT
+	privKey      crypto.PrivKey // signs the rooms that we put into the DHT
+	peerID       peer.ID        // our peer ID, for our DHT key
+	sink         Sink
+	lastProvided time.Time              // when we last provided the directory CID
+	found        map[peer.ID]*dhtSource // what was in the last record of each node
+	foundMutex   sync.Mutex             // protects found
+	metrics      dhtMetrics             // times the DHT operations
+}
+
+// dhtSource is what we found in the last record of another node.
+type dhtSource struct {
+	roomIDs  map[string]bool
+	lastSeen time.Time
+}
+
+// NewDHTTransport creates a transport which signs the rooms that it puts into
+// the DHT with the given key.
+func NewDHTTransport(dht *dht.IpfsDHT, privKey crypto.PrivKey) (*DHTTransport, error) {
+	peerID, err := peer.IDFromPrivateKey(privKey)
+	if err != nil {
+		return nil, err
+	}
+	return &DHTTransport{
+		dht:     dht,
+		privKey: privKey,
+		peerID:  peerID,
+		found:   make(map[peer.ID]*dhtSource),
+		metrics: newDHTMetrics(),
+	}, nil
+}
+
+func (t *DHTTransport) Name() string {
+	return "DHT"
+}
+
+func (t *DHTTransport) Start(ctx context.Context, sink Sink) error {
+	t.sink = sink
+	return nil
+}
+
+// Advertise puts our rooms into the DHT under our own key, and provides the
+// directory CID every DHTProvideInterval so that other nodes know to look for
+// them.
+func (t *DHTTransport) Advertise(ctx context.Context, rooms []gomatrixserverlib.PublicRoom) error {
+	j, err := json.Marshal(rooms)
+	if err != nil {
+		return err
+	}
+	key := dhtKeyPrefix + t.peerID.String()
+	sealed, err := signedrecord.Seal(t.privKey, key, j, DHTRecordTTL)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	err = t.dht.PutValue(ctx, key, sealed)
+	t.metrics.observe("put", start, err)
+	if err != nil {
+		return err
+	}
+	if time.Since(t.lastProvided) < DHTProvideInterval {
+		return nil
+	}
+	start = time.Now()
+	err = t.dht.Provide(ctx, directoryCID, true)
+	t.metrics.observe("provide", start, err)
+	if err != nil {
+		return err
+	}
+	t.lastProvided = time.Now()
+	return nil
+}
+
+// Refresh finds the nodes that provide the directory CID and fetches the
+// rooms that each of them has put into the DHT. The rooms are fetched from
+// several nodes at once, each with its own timeout, so that slow nodes don't
+// stop us from hearing about the rest.
+func (t *DHTTransport) Refresh(ctx context.Context) error {
+	// Forget the nodes whose records would have expired by now.
+	t.foundMutex.Lock()
+	for p, source := range t.found {
+		if time.Since(source.lastSeen) > DHTRecordTTL {
+			delete(t.found, p)
+		}
+	}
+	t.foundMutex.Unlock()
+
+	searchCtx, searchCancel := context.WithTimeout(ctx, DHTSearchTimeout)
+	defer searchCancel()
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, dhtFetchConcurrency)
+	for provider := range t.dht.FindProvidersAsync(searchCtx, directoryCID, maxDirectoryProviders) {
+		if provider.ID == t.peerID {
+			continue
+		}
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			wg.Wait()
+			return ctx.Err()
+		}
+		wg.Add(1)
+		go func(p peer.ID) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			t.fetch(ctx, p)
+		}(provider.ID)
+	}
+	wg.Wait()
+	return ctx.Err()
+}
+
+// fetch gets the rooms that a node has put into the DHT and passes them on to
+// the sink. Rooms that were in the previous record of the node but aren't in
+// this one are withdrawn.
+func (t *DHTTransport) fetch(ctx context.Context, p peer.ID) {
+	ctx, cancel := context.WithTimeout(ctx, DHTFetchTimeout)
+	defer cancel()
+	key := dhtKeyPrefix + p.String()
+	start := time.Now()
+	result, err := t.dht.GetValue(ctx, key)
+	t.metrics.observe("get", start, err)
+	if err != nil {
+		return
+	}
+	envelope, err := signedrecord.Open(key, result)
+	if err != nil {
+		return
+	}
+	var received []gomatrixserverlib.PublicRoom
+	if err := json.Unmarshal(envelope.Value, &received); err != nil {
+		return
+	}
+	roomIDs := make(map[string]bool, len(received))
+	for _, room := range received {
+		roomIDs[room.RoomID] = true
+	}
+	var withdrawn []string
+	t.foundMutex.Lock()
+	if previous, ok := t.found[p]; ok {
+		for roomID := range previous.roomIDs {
+			if !roomIDs[roomID] {
+				withdrawn = append(withdrawn, roomID)
+			}
+		}
+	}
+	t.found[p] = &dhtSource{roomIDs: roomIDs, lastSeen: time.Now()}
+	t.foundMutex.Unlock()
+	if len(withdrawn) > 0 {
+		t.sink.RoomsWithdrawn(p.String(), withdrawn)
+	}
+	t.sink.RoomsFound(p.String(), received)
+}
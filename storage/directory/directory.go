@@ -0,0 +1,389 @@
+// Copyright 2017-2018 New Vector Ltd
+// Copyright 2019-2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package directory adds peer-to-peer advertisement and discovery of public
+// rooms to any public rooms database. How rooms are shared with other nodes
+// is up to a Transport, so that new ways of sharing them can be added without
+// touching the storage code.
+package directory
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/matrix-org/dendrite/publicroomsapi/storage"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// MaintenanceInterval is how often we advertise our rooms and expire the
+// rooms that we haven't heard about for a while.
+const MaintenanceInterval = time.Second * 10
+
+// localFilter can be passed to GetPublicRooms to only return our own rooms.
+const localFilter = "__local__"
+
+// Transport shares our public rooms with other nodes and learns about theirs.
+type Transport interface {
+	// Name describes the transport, for logging.
+	Name() string
+	// Start starts the transport, which passes any rooms it learns about to the
+	// sink until the context is cancelled.
+	Start(ctx context.Context, sink Sink) error
+	// Advertise shares our public rooms with other nodes. It is called every
+	// MaintenanceInterval, and whenever the visibility of a room changes.
+	Advertise(ctx context.Context, rooms []gomatrixserverlib.PublicRoom) error
+	// Refresh actively looks for the rooms of other nodes, for transports that
+	// don't learn about them passively. It is called after every Advertise.
+	Refresh(ctx context.Context) error
+}
+
+// Sink receives the rooms that a Transport learns about.
+type Sink interface {
+	// RoomsFound is called with rooms that were announced by another node.
+	RoomsFound(source string, rooms []gomatrixserverlib.PublicRoom)
+	// RoomsSeen is called with the IDs of rooms that another node announced
+	// again without any changes.
+	RoomsSeen(source string, roomIDs []string)
+	// RoomsWithdrawn is called with the IDs of rooms that another node no
+	// longer announces.
+	RoomsWithdrawn(source string, roomIDs []string)
+}
+
+// DiscoveredRoom is a room that was announced by another node.
+type DiscoveredRoom struct {
+	Room      gomatrixserverlib.PublicRoom
+	Source    string    // the node that announced the room
+	FirstSeen time.Time // when we first heard about the room
+	LastSeen  time.Time // when we last heard about the room
+}
+
+// DiscoveredRoomsTable stores the rooms that were discovered from other
+// nodes, so that they survive restarts.
+type DiscoveredRoomsTable interface {
+	// UpsertDiscoveredRoom stores a room, keeping the time that it was first
+	// seen if it is already stored.
+	UpsertDiscoveredRoom(ctx context.Context, room DiscoveredRoom) error
+	SelectDiscoveredRooms(ctx context.Context) ([]DiscoveredRoom, error)
+	// DeleteExpiredDiscoveredRooms deletes the rooms that were last seen
+	// before the given time.
+	DeleteExpiredDiscoveredRooms(ctx context.Context, before time.Time) error
+	DeleteDiscoveredRoom(ctx context.Context, roomID string) error
+}
+
+// Database wraps a public rooms database, adding the rooms that have been
+// discovered from other nodes through a Transport.
+type Database struct {
+	roomsAdvertised  int64                     // how many rooms we last advertised, accessed atomically, first for 64-bit alignment
+	storage.Database                           // our own rooms
+	transport        Transport                 //
+	owns             ServerOwner               // checks that rooms belong to the node that announced them
+	table            DiscoveredRoomsTable      // persists foundRooms
+	ttl              time.Duration             // how long we keep rooms after we last heard about them
+	foundRooms       map[string]DiscoveredRoom // additional rooms we have learned about from other nodes
+	foundRoomsMutex  sync.RWMutex              // protects foundRooms
+	maintenanceTimer *time.Timer               //
+	maintenanceMutex sync.Mutex                // protects maintenanceTimer and serialises Interval
+	ctx              context.Context           // cancelled by Stop
+	cancel           context.CancelFunc        //
+}
+
+// NewDatabase wraps a public rooms database and starts advertising its rooms
+// through the transport. Rooms from other nodes are only accepted if owns says
+// that they belong to the node that announced them, whichever transport they
+// came from. Discovered rooms are stored in the table, and are forgotten when
+// we haven't heard about them for the TTL.
+func NewDatabase(db storage.Database, table DiscoveredRoomsTable, transport Transport, owns ServerOwner, ttl time.Duration) (*Database, error) {
+	d := &Database{
+		Database:   db,
+		transport:  transport,
+		owns:       owns,
+		table:      table,
+		ttl:        ttl,
+		foundRooms: make(map[string]DiscoveredRoom),
+	}
+	d.ctx, d.cancel = context.WithCancel(context.Background())
+
+	if err := table.DeleteExpiredDiscoveredRooms(d.ctx, time.Now().Add(-ttl)); err != nil {
+		d.cancel()
+		return nil, err
+	}
+	rooms, err := table.SelectDiscoveredRooms(d.ctx)
+	if err != nil {
+		d.cancel()
+		return nil, err
+	}
+	for _, room := range rooms {
+		d.foundRooms[room.Room.RoomID] = room
+	}
+
+	if err := transport.Start(d.ctx, d); err != nil {
+		d.cancel()
+		return nil, err
+	}
+	go d.MaintenanceTimer()
+	return d, nil
+}
+
+// RoomsFound implements Sink. Rooms which don't belong to the node that
+// announced them are ignored, so that nodes can't replace each other's rooms.
+func (d *Database) RoomsFound(source string, rooms []gomatrixserverlib.PublicRoom) {
+	now := time.Now()
+	d.foundRoomsMutex.Lock()
+	defer d.foundRoomsMutex.Unlock()
+	for _, room := range rooms {
+		if !d.owns.ownsRoom(room.RoomID, source) {
+			fmt.Println("Ignoring room", room.RoomID, "announced by", source, "which doesn't own it")
+			continue
+		}
+		found := DiscoveredRoom{
+			Room:      room,
+			Source:    source,
+			FirstSeen: now,
+			LastSeen:  now,
+		}
+		if existing, ok := d.foundRooms[room.RoomID]; ok {
+			found.FirstSeen = existing.FirstSeen
+		}
+		if err := d.table.UpsertDiscoveredRoom(d.ctx, found); err != nil {
+			fmt.Println("Failed to store discovered room:", err)
+		}
+		d.foundRooms[room.RoomID] = found
+	}
+}
+
+// DiscoveredRooms returns the rooms that we currently know about from other
+// nodes, with where and when we heard about them.
+func (d *Database) DiscoveredRooms() []DiscoveredRoom {
+	d.foundRoomsMutex.RLock()
+	defer d.foundRoomsMutex.RUnlock()
+	rooms := make([]DiscoveredRoom, 0, len(d.foundRooms))
+	for _, found := range d.foundRooms {
+		rooms = append(rooms, found)
+	}
+	sort.Slice(rooms, func(i, j int) bool {
+		return rooms[i].Room.RoomID < rooms[j].Room.RoomID
+	})
+	return rooms
+}
+
+// RoomsSeen implements Sink.
+func (d *Database) RoomsSeen(source string, roomIDs []string) {
+	now := time.Now()
+	d.foundRoomsMutex.Lock()
+	defer d.foundRoomsMutex.Unlock()
+	for _, roomID := range roomIDs {
+		found, ok := d.foundRooms[roomID]
+		if !ok || found.Source != source {
+			continue
+		}
+		found.LastSeen = now
+		if err := d.table.UpsertDiscoveredRoom(d.ctx, found); err != nil {
+			fmt.Println("Failed to store discovered room:", err)
+		}
+		d.foundRooms[roomID] = found
+	}
+}
+
+// RoomsWithdrawn implements Sink. Rooms are only forgotten if they were last
+// announced by the node that withdrew them.
+func (d *Database) RoomsWithdrawn(source string, roomIDs []string) {
+	d.foundRoomsMutex.Lock()
+	defer d.foundRoomsMutex.Unlock()
+	for _, roomID := range roomIDs {
+		found, ok := d.foundRooms[roomID]
+		if !ok || found.Source != source {
+			continue
+		}
+		if err := d.table.DeleteDiscoveredRoom(d.ctx, roomID); err != nil {
+			fmt.Println("Failed to delete discovered room:", err)
+		}
+		delete(d.foundRooms, roomID)
+	}
+}
+
+func (d *Database) SetRoomVisibility(ctx context.Context, visible bool, roomID string) error {
+	if err := d.Database.SetRoomVisibility(ctx, visible, roomID); err != nil {
+		return err
+	}
+	d.MaintenanceTimer()
+	return nil
+}
+
+// CountPublicRooms returns the number of our own rooms plus the number of
+// discovered rooms that aren't also our own.
+func (d *Database) CountPublicRooms(ctx context.Context) (int64, error) {
+	rooms, err := d.allPublicRooms(ctx, "")
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(rooms)), nil
+}
+
+// GetPublicRooms returns a page of our own rooms and discovered rooms, which
+// are ordered together by the number of joined members. If a filter is given
+// then only rooms with it in their name, topic or aliases are returned.
+func (d *Database) GetPublicRooms(ctx context.Context, offset int64, limit int16, filter string) ([]gomatrixserverlib.PublicRoom, error) {
+	if filter == localFilter {
+		return d.Database.GetPublicRooms(ctx, offset, limit, "")
+	}
+	rooms, err := d.allPublicRooms(ctx, filter)
+	if err != nil {
+		return []gomatrixserverlib.PublicRoom{}, err
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	if offset >= int64(len(rooms)) {
+		return []gomatrixserverlib.PublicRoom{}, nil
+	}
+	rooms = rooms[offset:]
+	if limit > 0 && int(limit) < len(rooms) {
+		rooms = rooms[:limit]
+	}
+	return rooms, nil
+}
+
+// allPublicRooms returns all of our own rooms and discovered rooms which
+// match the filter, with the most joined members first. Rooms with the same
+// number of members are ordered by room ID so that pages are stable.
+func (d *Database) allPublicRooms(ctx context.Context, filter string) ([]gomatrixserverlib.PublicRoom, error) {
+	local, err := d.Database.GetPublicRooms(ctx, 0, math.MaxInt16, "")
+	if err != nil {
+		return nil, err
+	}
+	localRoomIDs := make(map[string]bool, len(local))
+	rooms := make([]gomatrixserverlib.PublicRoom, 0, len(local))
+	for _, room := range local {
+		localRoomIDs[room.RoomID] = true
+		if matchesFilter(room, filter) {
+			rooms = append(rooms, room)
+		}
+	}
+
+	d.foundRoomsMutex.RLock()
+	for roomID, found := range d.foundRooms {
+		if !localRoomIDs[roomID] && matchesFilter(found.Room, filter) {
+			rooms = append(rooms, found.Room)
+		}
+	}
+	d.foundRoomsMutex.RUnlock()
+
+	sort.Slice(rooms, func(i, j int) bool {
+		if rooms[i].JoinedMembersCount != rooms[j].JoinedMembersCount {
+			return rooms[i].JoinedMembersCount > rooms[j].JoinedMembersCount
+		}
+		return rooms[i].RoomID < rooms[j].RoomID
+	})
+	return rooms, nil
+}
+
+// matchesFilter returns true if the filter appears in the name, topic or any
+// of the aliases of the room, ignoring case. An empty filter matches all rooms.
+func matchesFilter(room gomatrixserverlib.PublicRoom, filter string) bool {
+	if filter == "" {
+		return true
+	}
+	filter = strings.ToLower(filter)
+	if strings.Contains(strings.ToLower(room.Name), filter) ||
+		strings.Contains(strings.ToLower(room.Topic), filter) ||
+		strings.Contains(strings.ToLower(room.CanonicalAlias), filter) {
+		return true
+	}
+	for _, alias := range room.Aliases {
+		if strings.Contains(strings.ToLower(alias), filter) {
+			return true
+		}
+	}
+	return false
+}
+
+// MaintenanceTimer advertises our rooms straight away, and then every
+// MaintenanceInterval.
+func (d *Database) MaintenanceTimer() {
+	d.Interval()
+}
+
+// Stop stops advertising our rooms, stops the transport and closes the table
+// of discovered rooms and the wrapped database, if they can be closed.
+func (d *Database) Stop() {
+	d.cancel()
+	d.maintenanceMutex.Lock()
+	if d.maintenanceTimer != nil {
+		d.maintenanceTimer.Stop()
+	}
+	d.maintenanceMutex.Unlock()
+	if closer, ok := d.table.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			fmt.Println("Failed to close discovered rooms table:", err)
+		}
+	}
+	if closer, ok := d.Database.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			fmt.Println("Failed to close public rooms database:", err)
+		}
+	}
+}
+
+func (d *Database) Interval() {
+	d.maintenanceMutex.Lock()
+	defer d.maintenanceMutex.Unlock()
+	if d.ctx.Err() != nil {
+		return
+	}
+	expiry := time.Now().Add(-d.ttl)
+	d.foundRoomsMutex.Lock()
+	for k, v := range d.foundRooms {
+		if v.LastSeen.Before(expiry) {
+			delete(d.foundRooms, k)
+		}
+	}
+	d.foundRoomsMutex.Unlock()
+	if err := d.table.DeleteExpiredDiscoveredRooms(d.ctx, expiry); err != nil {
+		fmt.Println("Failed to expire discovered rooms:", err)
+	}
+	if err := d.AdvertiseRooms(); err != nil {
+		fmt.Println("Failed to advertise rooms via", d.transport.Name()+":", err)
+	}
+	if err := d.transport.Refresh(d.ctx); err != nil {
+		fmt.Println("Failed to find rooms via", d.transport.Name()+":", err)
+	}
+	// Interval may have been called early by MaintenanceTimer, in which case
+	// the previous timer is still pending.
+	if d.maintenanceTimer != nil {
+		d.maintenanceTimer.Stop()
+	}
+	d.maintenanceTimer = time.AfterFunc(MaintenanceInterval, d.Interval)
+}
+
+func (d *Database) AdvertiseRooms() error {
+	dbCtx, dbCancel := context.WithTimeout(d.ctx, 3*time.Second)
+	defer dbCancel()
+	ourRooms, err := d.Database.GetPublicRooms(dbCtx, 0, math.MaxInt16, "")
+	if err != nil {
+		return err
+	}
+	if err = d.transport.Advertise(d.ctx, ourRooms); err != nil {
+		return err
+	}
+	atomic.StoreInt64(&d.roomsAdvertised, int64(len(ourRooms)))
+	return nil
+}
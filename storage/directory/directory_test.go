@@ -0,0 +1,198 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package directory
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/publicroomsapi/storage"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// fakeRoomsDatabase is a public rooms database holding our own rooms. Only
+// GetPublicRooms is implemented.
+type fakeRoomsDatabase struct {
+	storage.Database
+	rooms []gomatrixserverlib.PublicRoom
+}
+
+func (db *fakeRoomsDatabase) GetPublicRooms(ctx context.Context, offset int64, limit int16, filter string) ([]gomatrixserverlib.PublicRoom, error) {
+	rooms := db.rooms
+	if offset >= int64(len(rooms)) {
+		return []gomatrixserverlib.PublicRoom{}, nil
+	}
+	rooms = rooms[offset:]
+	if limit > 0 && int(limit) < len(rooms) {
+		rooms = rooms[:limit]
+	}
+	return rooms, nil
+}
+
+// fakeDiscoveredRoomsTable starts out with some discovered rooms, and
+// otherwise doesn't store anything.
+type fakeDiscoveredRoomsTable struct {
+	rooms []DiscoveredRoom
+}
+
+func (t *fakeDiscoveredRoomsTable) UpsertDiscoveredRoom(ctx context.Context, room DiscoveredRoom) error {
+	return nil
+}
+
+func (t *fakeDiscoveredRoomsTable) SelectDiscoveredRooms(ctx context.Context) ([]DiscoveredRoom, error) {
+	return t.rooms, nil
+}
+
+func (t *fakeDiscoveredRoomsTable) DeleteExpiredDiscoveredRooms(ctx context.Context, before time.Time) error {
+	return nil
+}
+
+func (t *fakeDiscoveredRoomsTable) DeleteDiscoveredRoom(ctx context.Context, roomID string) error {
+	return nil
+}
+
+// fakeTransport neither shares nor learns about any rooms.
+type fakeTransport struct{}
+
+func (fakeTransport) Name() string {
+	return "fake"
+}
+
+func (fakeTransport) Start(ctx context.Context, sink Sink) error {
+	return nil
+}
+
+func (fakeTransport) Advertise(ctx context.Context, rooms []gomatrixserverlib.PublicRoom) error {
+	return nil
+}
+
+func (fakeTransport) Refresh(ctx context.Context) error {
+	return nil
+}
+
+func newTestDatabase(t *testing.T, local []gomatrixserverlib.PublicRoom, discovered []gomatrixserverlib.PublicRoom) *Database {
+	t.Helper()
+	now := time.Now()
+	table := &fakeDiscoveredRoomsTable{}
+	for _, room := range discovered {
+		table.rooms = append(table.rooms, DiscoveredRoom{
+			Room:      room,
+			Source:    "remote",
+			FirstSeen: now,
+			LastSeen:  now,
+		})
+	}
+	d, err := NewDatabase(&fakeRoomsDatabase{rooms: local}, table, fakeTransport{}, PeerIDOwner, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func roomIDs(rooms []gomatrixserverlib.PublicRoom) []string {
+	ids := []string{}
+	for _, room := range rooms {
+		ids = append(ids, room.RoomID)
+	}
+	return ids
+}
+
+func TestGetPublicRooms(t *testing.T) {
+	a := gomatrixserverlib.PublicRoom{RoomID: "!a:local", JoinedMembersCount: 5, Name: "Cats"}
+	b := gomatrixserverlib.PublicRoom{RoomID: "!b:local", JoinedMembersCount: 3, Topic: "All about dogs"}
+	c := gomatrixserverlib.PublicRoom{RoomID: "!c:remote", JoinedMembersCount: 5, Aliases: []string{"#birds:remote"}}
+	d := gomatrixserverlib.PublicRoom{RoomID: "!d:remote", JoinedMembersCount: 3, CanonicalAlias: "#Fish:remote"}
+	e := gomatrixserverlib.PublicRoom{RoomID: "!e:remote", JoinedMembersCount: 7}
+	// !a:local was also announced by another node, but is only listed once.
+	db := newTestDatabase(t,
+		[]gomatrixserverlib.PublicRoom{a, b},
+		[]gomatrixserverlib.PublicRoom{d, a, c, e},
+	)
+	defer db.Stop()
+
+	tests := []struct {
+		name   string
+		offset int64
+		limit  int16
+		filter string
+		want   []string
+	}{
+		{name: "all", want: []string{"!e:remote", "!a:local", "!c:remote", "!b:local", "!d:remote"}},
+		{name: "limit", limit: 2, want: []string{"!e:remote", "!a:local"}},
+		{name: "offset and limit", offset: 2, limit: 2, want: []string{"!c:remote", "!b:local"}},
+		{name: "offset near the end", offset: 4, limit: 2, want: []string{"!d:remote"}},
+		{name: "offset at the end", offset: 5, want: []string{}},
+		{name: "offset past the end", offset: 50, limit: 2, want: []string{}},
+		{name: "negative offset", offset: -1, limit: 1, want: []string{"!e:remote"}},
+		{name: "name", filter: "cat", want: []string{"!a:local"}},
+		{name: "topic", filter: "DOGS", want: []string{"!b:local"}},
+		{name: "alias", filter: "birds", want: []string{"!c:remote"}},
+		{name: "canonical alias", filter: "fish", want: []string{"!d:remote"}},
+		{name: "no match", filter: "horses", want: []string{}},
+		{name: "local only", filter: localFilter, want: []string{"!a:local", "!b:local"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Discovered rooms are kept in a map, so ask several times to
+			// check that rooms with the same member count keep their order.
+			for i := 0; i < 10; i++ {
+				rooms, err := db.GetPublicRooms(context.Background(), test.offset, test.limit, test.filter)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := roomIDs(rooms); !reflect.DeepEqual(got, test.want) {
+					t.Fatalf("got %v, want %v", got, test.want)
+				}
+			}
+		})
+	}
+
+	count, err := db.CountPublicRooms(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 5 {
+		t.Errorf("counted %d rooms, want 5", count)
+	}
+}
+
+func TestMatchesFilter(t *testing.T) {
+	room := gomatrixserverlib.PublicRoom{
+		RoomID:         "!room:local",
+		Name:           "Matrix HQ",
+		Topic:          "The Official Matrix HQ",
+		CanonicalAlias: "#matrix:matrix.org",
+		Aliases:        []string{"#hq:local", "#Lobby:local"},
+	}
+	tests := []struct {
+		filter string
+		want   bool
+	}{
+		{filter: "", want: true},
+		{filter: "hq", want: true},
+		{filter: "official", want: true},
+		{filter: "#matrix:", want: true},
+		{filter: "lobby", want: true},
+		{filter: "!room", want: false},
+		{filter: "dendrite", want: false},
+	}
+	for _, test := range tests {
+		if got := matchesFilter(room, test.filter); got != test.want {
+			t.Errorf("matchesFilter(%q) = %v, want %v", test.filter, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package directory
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// pubSubMetrics counts the messages of a PubSubTransport.
+type pubSubMetrics struct {
+	sent     *prometheus.CounterVec
+	received *prometheus.CounterVec
+	rejected *prometheus.CounterVec
+}
+
+func newPubSubMetrics() pubSubMetrics {
+	return pubSubMetrics{
+		sent: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "dendrite",
+				Subsystem: "p2p",
+				Name:      "pubsub_sent_messages_total",
+				Help:      "Number of public room messages published on pubsub, by type.",
+			},
+			[]string{"type"},
+		),
+		received: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "dendrite",
+				Subsystem: "p2p",
+				Name:      "pubsub_received_messages_total",
+				Help:      "Number of public room messages received from other nodes on pubsub, by type.",
+			},
+			[]string{"type"},
+		),
+		rejected: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "dendrite",
+				Subsystem: "p2p",
+				Name:      "pubsub_rejected_messages_total",
+				Help:      "Number of public room messages rejected by the pubsub validator, by reason.",
+			},
+			[]string{"reason"},
+		),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (t *PubSubTransport) Describe(ch chan<- *prometheus.Desc) {
+	t.metrics.sent.Describe(ch)
+	t.metrics.received.Describe(ch)
+	t.metrics.rejected.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (t *PubSubTransport) Collect(ch chan<- prometheus.Metric) {
+	t.metrics.sent.Collect(ch)
+	t.metrics.received.Collect(ch)
+	t.metrics.rejected.Collect(ch)
+}
+
+// dhtMetrics times the DHT operations of a DHTTransport.
+type dhtMetrics struct {
+	duration *prometheus.HistogramVec
+	failures *prometheus.CounterVec
+}
+
+func newDHTMetrics() dhtMetrics {
+	return dhtMetrics{
+		duration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: "dendrite",
+				Subsystem: "p2p",
+				Name:      "dht_duration_seconds",
+				Help:      "How long DHT operations for public rooms took, by operation.",
+				Buckets:   []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+			},
+			[]string{"operation"},
+		),
+		failures: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "dendrite",
+				Subsystem: "p2p",
+				Name:      "dht_failures_total",
+				Help:      "Number of DHT operations for public rooms that failed, by operation.",
+			},
+			[]string{"operation"},
+		),
+	}
+}
+
+// observe records how long a DHT operation took and whether it failed.
+func (m dhtMetrics) observe(operation string, start time.Time, err error) {
+	m.duration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+	if err != nil {
+		m.failures.WithLabelValues(operation).Inc()
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (t *DHTTransport) Describe(ch chan<- *prometheus.Desc) {
+	t.metrics.duration.Describe(ch)
+	t.metrics.failures.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (t *DHTTransport) Collect(ch chan<- prometheus.Metric) {
+	t.metrics.duration.Collect(ch)
+	t.metrics.failures.Collect(ch)
+}
+
+var (
+	roomsAdvertisedDesc = prometheus.NewDesc(
+		"dendrite_p2p_rooms_advertised",
+		"Number of our public rooms that were last advertised, by backend.",
+		[]string{"backend"}, nil,
+	)
+	roomsDiscoveredDesc = prometheus.NewDesc(
+		"dendrite_p2p_rooms_discovered",
+		"Number of public rooms that we know about from other nodes, by backend.",
+		[]string{"backend"}, nil,
+	)
+)
+
+// Describe implements prometheus.Collector. The metrics of the transport are
+// included, so that registering the Database registers all of its metrics.
+func (d *Database) Describe(ch chan<- *prometheus.Desc) {
+	ch <- roomsAdvertisedDesc
+	ch <- roomsDiscoveredDesc
+	if collector, ok := d.transport.(prometheus.Collector); ok {
+		collector.Describe(ch)
+	}
+}
+
+// Collect implements prometheus.Collector.
+func (d *Database) Collect(ch chan<- prometheus.Metric) {
+	if collector, ok := d.transport.(prometheus.Collector); ok {
+		collector.Collect(ch)
+	}
+	ch <- prometheus.MustNewConstMetric(
+		roomsAdvertisedDesc, prometheus.GaugeValue,
+		float64(atomic.LoadInt64(&d.roomsAdvertised)), d.transport.Name(),
+	)
+	d.foundRoomsMutex.RLock()
+	discovered := len(d.foundRooms)
+	d.foundRoomsMutex.RUnlock()
+	ch <- prometheus.MustNewConstMetric(
+		roomsDiscoveredDesc, prometheus.GaugeValue,
+		float64(discovered), d.transport.Name(),
+	)
+}
@@ -0,0 +1,381 @@
+// Copyright 2019-2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package directory
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// PubSubTopic is the pubsub topic that public rooms are announced on, unless
+// another one is given to NewPubSubTransport.
+const PubSubTopic = "/matrix/publicRooms"
+
+// pubSubSourceTTL is how long we remember the room versions that a node has
+// announced after we last heard from it. If we forget them, we just ask for
+// its rooms again when we next see its digest.
+const pubSubSourceTTL = MaintenanceInterval * 6
+
+// The types of message sent on the public rooms topic.
+const (
+	// A digest lists the version of every public room of the sender. It is
+	// sent every time that the rooms are advertised.
+	pubSubDigest = "digest"
+	// A rooms message holds the full data of the rooms of the sender that
+	// have changed, or that another node asked for.
+	pubSubRooms = "rooms"
+	// A withdraw message lists the rooms of the sender that are no longer
+	// public.
+	pubSubWithdraw = "withdraw"
+	// A want message asks a node for the full data of some of its rooms, if
+	// we saw them in its digest but don't have the same version.
+	pubSubWant = "want"
+)
+
+// pubSubMessage is a message on the public rooms topic. Which fields are set
+// depends on the type.
+type pubSubMessage struct {
+	Type     string                         `json:"type"`
+	Versions map[string]string              `json:"versions,omitempty"` // digest: room ID to version
+	Rooms    []gomatrixserverlib.PublicRoom `json:"rooms,omitempty"`    // rooms
+	RoomIDs  []string                       `json:"room_ids,omitempty"` // withdraw, want
+	Peer     string                         `json:"peer,omitempty"`     // want: the node being asked
+}
+
+// ServerOwner returns whether a server name belongs to a peer.
+type ServerOwner func(serverName string, p peer.ID) bool
+
+// PeerIDOwner is a ServerOwner for nodes whose server names are their peer
+// IDs.
+func PeerIDOwner(serverName string, p peer.ID) bool {
+	return serverName == p.String()
+}
+
+// ownsRoom returns whether the server part of the room ID belongs to the
+// node with the given peer ID.
+func (owns ServerOwner) ownsRoom(roomID string, source string) bool {
+	_, domain, err := gomatrixserverlib.SplitID('!', roomID)
+	if err != nil {
+		return false
+	}
+	p, err := peer.IDB58Decode(source)
+	if err != nil {
+		return false
+	}
+	return owns(string(domain), p)
+}
+
+// pubSubSource is what we know about the rooms of another node.
+type pubSubSource struct {
+	versions map[string]string // room ID to the version we have
+	lastSeen time.Time
+}
+
+// PubSubTransport announces our public rooms on a pubsub topic, and listens
+// for the rooms that other nodes announce. Rather than sending every room
+// every time, it sends a digest of room versions, and only sends the full
+// data of a room when it changes or when another node asks for it.
+type PubSubTransport struct {
+	pubsub       *pubsub.PubSub
+	topicName    string
+	owns         ServerOwner // checks that announced rooms belong to their sender
+	self         peer.ID     // our own peer ID, so we can ignore our own messages
+	topic        *pubsub.Topic
+	subscription *pubsub.Subscription
+	advertised   map[string]string        // room ID to the version we last sent
+	wanted       map[string]bool          // room IDs that other nodes asked for
+	sources      map[string]*pubSubSource // peer ID to what we know about its rooms
+	mutex        sync.Mutex               // protects the above
+	limiter      *rateLimiter             // limits how many messages each node can send
+	metrics      pubSubMetrics            // counts the messages sent, received and rejected
+}
+
+// NewPubSubTransport registers a validator for the public rooms topic and
+// joins it. The topic is used for the lifetime of the transport. Rooms are
+// only accepted from the node that the server name in their room ID belongs
+// to, according to owns.
+func NewPubSubTransport(ps *pubsub.PubSub, self peer.ID, topicName string, owns ServerOwner) (*PubSubTransport, error) {
+	t := &PubSubTransport{
+		pubsub:     ps,
+		topicName:  topicName,
+		owns:       owns,
+		self:       self,
+		advertised: make(map[string]string),
+		wanted:     make(map[string]bool),
+		sources:    make(map[string]*pubSubSource),
+		limiter:    newRateLimiter(pubSubRateLimit, pubSubRateWindow),
+		metrics:    newPubSubMetrics(),
+	}
+	if err := ps.RegisterTopicValidator(topicName, t.validate); err != nil {
+		return nil, fmt.Errorf("failed to register public rooms validator: %w", err)
+	}
+	topic, err := ps.Join(topicName)
+	if err != nil {
+		ps.UnregisterTopicValidator(topicName) // nolint: errcheck
+		return nil, err
+	}
+	sub, err := topic.Subscribe()
+	if err != nil {
+		topic.Close()                          // nolint: errcheck
+		ps.UnregisterTopicValidator(topicName) // nolint: errcheck
+		return nil, err
+	}
+	t.topic = topic
+	t.subscription = sub
+	return t, nil
+}
+
+func (t *PubSubTransport) Name() string {
+	return "pubsub"
+}
+
+func (t *PubSubTransport) Start(ctx context.Context, sink Sink) error {
+	go func() {
+		<-ctx.Done()
+		t.Close() // nolint: errcheck
+	}()
+	go t.receive(ctx, sink)
+	return nil
+}
+
+// Close leaves the topic and unregisters the validator. It is called when the
+// context given to Start is cancelled, and only needs to be called directly
+// if the transport was never started.
+func (t *PubSubTransport) Close() error {
+	t.subscription.Cancel()
+	t.topic.Close()                                // nolint: errcheck
+	t.pubsub.UnregisterTopicValidator(t.topicName) // nolint: errcheck
+	return nil
+}
+
+func (t *PubSubTransport) receive(ctx context.Context, sink Sink) {
+	for {
+		msg, err := t.subscription.Next(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			continue
+		}
+		source := msg.GetFrom()
+		if source == t.self {
+			continue
+		}
+		var m pubSubMessage
+		if err := json.Unmarshal(msg.Data, &m); err != nil {
+			fmt.Println("Unmarshal error:", err)
+			continue
+		}
+		t.metrics.received.WithLabelValues(m.Type).Inc()
+		switch m.Type {
+		case pubSubDigest:
+			t.handleDigest(ctx, sink, source.String(), m.Versions)
+		case pubSubRooms:
+			t.handleRooms(sink, source.String(), m.Rooms)
+		case pubSubWithdraw:
+			t.handleWithdraw(sink, source.String(), m.RoomIDs)
+		case pubSubWant:
+			t.handleWant(m.Peer, m.RoomIDs)
+		}
+	}
+}
+
+// handleDigest refreshes the rooms in the digest that we already have, forgets
+// the ones that are missing from it, and asks for the ones that we don't have.
+func (t *PubSubTransport) handleDigest(ctx context.Context, sink Sink, source string, versions map[string]string) {
+	var seen, withdrawn, wanted []string
+	t.mutex.Lock()
+	src := t.source(source)
+	for roomID, version := range versions {
+		if src.versions[roomID] == version {
+			seen = append(seen, roomID)
+		} else {
+			wanted = append(wanted, roomID)
+		}
+	}
+	for roomID := range src.versions {
+		if _, ok := versions[roomID]; !ok {
+			withdrawn = append(withdrawn, roomID)
+			delete(src.versions, roomID)
+		}
+	}
+	t.mutex.Unlock()
+
+	if len(seen) > 0 {
+		sink.RoomsSeen(source, seen)
+	}
+	if len(withdrawn) > 0 {
+		sink.RoomsWithdrawn(source, withdrawn)
+	}
+	if len(wanted) > 0 {
+		if err := t.publish(ctx, pubSubMessage{Type: pubSubWant, Peer: source, RoomIDs: wanted}); err != nil {
+			fmt.Println("Failed to ask for public rooms:", err)
+		}
+	}
+}
+
+func (t *PubSubTransport) handleRooms(sink Sink, source string, rooms []gomatrixserverlib.PublicRoom) {
+	t.mutex.Lock()
+	src := t.source(source)
+	for _, room := range rooms {
+		version, err := roomVersion(room)
+		if err != nil {
+			continue
+		}
+		src.versions[room.RoomID] = version
+	}
+	t.mutex.Unlock()
+	sink.RoomsFound(source, rooms)
+}
+
+func (t *PubSubTransport) handleWithdraw(sink Sink, source string, roomIDs []string) {
+	t.mutex.Lock()
+	src := t.source(source)
+	for _, roomID := range roomIDs {
+		delete(src.versions, roomID)
+	}
+	t.mutex.Unlock()
+	sink.RoomsWithdrawn(source, roomIDs)
+}
+
+// handleWant remembers the rooms that another node asked us for, so that we
+// send them the next time that we advertise.
+func (t *PubSubTransport) handleWant(target string, roomIDs []string) {
+	if target != t.self.String() {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for _, roomID := range roomIDs {
+		if _, ok := t.advertised[roomID]; ok {
+			t.wanted[roomID] = true
+		}
+	}
+}
+
+// source returns what we know about the rooms of a node. The mutex must be
+// held.
+func (t *PubSubTransport) source(source string) *pubSubSource {
+	src, ok := t.sources[source]
+	if !ok {
+		src = &pubSubSource{versions: make(map[string]string)}
+		t.sources[source] = src
+	}
+	src.lastSeen = time.Now()
+	return src
+}
+
+// Advertise sends the full data of the rooms that have changed or that were
+// asked for, withdraws the rooms that are no longer public, and then sends a
+// digest of all of the rooms. Rooms that other nodes would reject, e.g. rooms
+// created by another server that a local user published, are left out, as
+// they would get every message that they are in rejected.
+func (t *PubSubTransport) Advertise(ctx context.Context, rooms []gomatrixserverlib.PublicRoom) error {
+	versions := make(map[string]string, len(rooms))
+	var changed []gomatrixserverlib.PublicRoom
+	var withdrawn []string
+	t.mutex.Lock()
+	for _, room := range rooms {
+		if t.checkRoom(room, t.self) != "" {
+			continue
+		}
+		version, err := roomVersion(room)
+		if err != nil {
+			t.mutex.Unlock()
+			return err
+		}
+		versions[room.RoomID] = version
+		if t.advertised[room.RoomID] != version || t.wanted[room.RoomID] {
+			changed = append(changed, room)
+		}
+	}
+	for roomID := range t.advertised {
+		if _, ok := versions[roomID]; !ok {
+			withdrawn = append(withdrawn, roomID)
+		}
+	}
+	t.mutex.Unlock()
+
+	for len(changed) > 0 {
+		batch := changed
+		if len(batch) > pubSubMaxRooms {
+			batch = batch[:pubSubMaxRooms]
+		}
+		changed = changed[len(batch):]
+		if err := t.publish(ctx, pubSubMessage{Type: pubSubRooms, Rooms: batch}); err != nil {
+			return fmt.Errorf("failed to publish public rooms: %w", err)
+		}
+	}
+	if len(withdrawn) > 0 {
+		if err := t.publish(ctx, pubSubMessage{Type: pubSubWithdraw, RoomIDs: withdrawn}); err != nil {
+			return fmt.Errorf("failed to withdraw public rooms: %w", err)
+		}
+	}
+	t.mutex.Lock()
+	t.advertised = versions
+	t.wanted = make(map[string]bool)
+	t.mutex.Unlock()
+
+	if err := t.publish(ctx, pubSubMessage{Type: pubSubDigest, Versions: versions}); err != nil {
+		return fmt.Errorf("failed to publish public rooms digest: %w", err)
+	}
+	return nil
+}
+
+func (t *PubSubTransport) publish(ctx context.Context, m pubSubMessage) error {
+	j, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if err = t.topic.Publish(ctx, j); err != nil {
+		return err
+	}
+	t.metrics.sent.WithLabelValues(m.Type).Inc()
+	return nil
+}
+
+// Refresh forgets about the nodes that we haven't heard from in a while. Rooms
+// are announced to us as they are advertised, so there is nothing to fetch.
+func (t *PubSubTransport) Refresh(ctx context.Context) error {
+	t.limiter.prune()
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for source, src := range t.sources {
+		if time.Since(src.lastSeen) > pubSubSourceTTL {
+			delete(t.sources, source)
+		}
+	}
+	return nil
+}
+
+// roomVersion returns a short hash of the room, which changes whenever any of
+// its fields change.
+func roomVersion(room gomatrixserverlib.PublicRoom) (string, error) {
+	j, err := json.Marshal(room)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(j)
+	return base64.RawStdEncoding.EncodeToString(sum[:12]), nil
+}
@@ -0,0 +1,106 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package directory
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func newTestPubSubTransport(ctx context.Context, t *testing.T) *PubSubTransport {
+	t.Helper()
+	host, err := libp2p.New(ctx, libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		<-ctx.Done()
+		host.Close() // nolint: errcheck
+	}()
+	ps, err := pubsub.NewGossipSub(ctx, host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport, err := NewPubSubTransport(ps, host.ID(), PubSubTopic, PeerIDOwner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return transport
+}
+
+// nextMessage returns the next message that we published on the topic.
+func nextMessage(ctx context.Context, t *testing.T, transport *PubSubTransport) pubSubMessage {
+	t.Helper()
+	msg, err := transport.subscription.Next(ctx)
+	if err != nil {
+		t.Fatalf("no message received: %v", err)
+	}
+	var m pubSubMessage
+	if err = json.Unmarshal(msg.Data, &m); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestAdvertiseLeavesOutRoomsOfOtherServers(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	transport := newTestPubSubTransport(ctx, t)
+	defer transport.Close() // nolint: errcheck
+
+	self := transport.self.String()
+	rooms := []gomatrixserverlib.PublicRoom{
+		{RoomID: "!ours:" + self, Name: "Ours"},
+		{RoomID: "!joined:matrix.org", Name: "Joined over federation"},
+		{RoomID: "!alsoours:" + self, Name: "Also ours"},
+	}
+	if err := transport.Advertise(ctx, rooms); err != nil {
+		t.Fatalf("failed to advertise: %v", err)
+	}
+	want := []string{"!alsoours:" + self, "!ours:" + self}
+
+	// Our own messages pass through the validator as well, so they are only
+	// delivered if the room of the other server was left out. They are
+	// validated concurrently, so they may arrive in any order.
+	messages := map[string]pubSubMessage{}
+	for len(messages) < 2 {
+		m := nextMessage(ctx, t, transport)
+		messages[m.Type] = m
+	}
+	var got []string
+	for _, room := range messages[pubSubRooms].Rooms {
+		got = append(got, room.RoomID)
+	}
+	sort.Strings(got)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("sent rooms %v, want %v", got, want)
+	}
+	got = nil
+	for roomID := range messages[pubSubDigest].Versions {
+		got = append(got, roomID)
+	}
+	sort.Strings(got)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("sent digest of %v, want %v", got, want)
+	}
+}
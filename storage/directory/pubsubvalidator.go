@@ -0,0 +1,212 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package directory
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// The limits on messages on the public rooms topic. Messages that break them
+// are dropped by the validator rather than being passed on to other nodes.
+const (
+	pubSubMaxMessageSize = 256 * 1024 // bytes
+	pubSubMaxRooms       = 32         // rooms in a rooms message
+	pubSubMaxRoomIDs     = 4096       // room IDs in any other message
+	pubSubMaxFieldLength = 1024       // bytes in any string field of a room
+	pubSubMaxAliases     = 32         // aliases of a room
+)
+
+// pubSubRateLimit is how many messages a node may send on the public rooms
+// topic in each pubSubRateWindow. A node normally sends a digest and a few
+// batches of rooms every MaintenanceInterval, so this leaves plenty of room.
+const (
+	pubSubRateLimit  = 64
+	pubSubRateWindow = MaintenanceInterval
+)
+
+// The reasons that a message can be rejected for, used to label the metric.
+const (
+	rejectedSize    = "size"
+	rejectedSchema  = "schema"
+	rejectedSpoofed = "spoofed"
+	rejectedRate    = "rate"
+)
+
+// validate rejects messages that are malformed, too large, that announce
+// rooms which don't belong to the node that signed them, or that come from
+// a node which is sending too many. Rejected messages are neither delivered
+// to us nor forwarded to other nodes.
+func (t *PubSubTransport) validate(_ context.Context, _ peer.ID, msg *pubsub.Message) bool {
+	if reason := t.check(msg); reason != "" {
+		t.metrics.rejected.WithLabelValues(reason).Inc()
+		return false
+	}
+	return true
+}
+
+// check returns why a message should be rejected, or "" if it is valid.
+func (t *PubSubTransport) check(msg *pubsub.Message) string {
+	if len(msg.Data) > pubSubMaxMessageSize {
+		return rejectedSize
+	}
+	// Messages are signed, so the sender can't be forged. The sender is the
+	// node that published the message, not the one that forwarded it to us.
+	from := msg.GetFrom()
+	if from != t.self && !t.limiter.allow(from) {
+		return rejectedRate
+	}
+
+	var m pubSubMessage
+	if err := json.Unmarshal(msg.Data, &m); err != nil {
+		return rejectedSchema
+	}
+	switch m.Type {
+	case pubSubDigest:
+		if len(m.Versions) > pubSubMaxRoomIDs {
+			return rejectedSize
+		}
+		for roomID := range m.Versions {
+			if reason := t.checkRoomID(roomID, from); reason != "" {
+				return reason
+			}
+		}
+	case pubSubRooms:
+		if len(m.Rooms) == 0 {
+			return rejectedSchema
+		}
+		if len(m.Rooms) > pubSubMaxRooms {
+			return rejectedSize
+		}
+		for _, room := range m.Rooms {
+			if reason := t.checkRoom(room, from); reason != "" {
+				return reason
+			}
+		}
+	case pubSubWithdraw, pubSubWant:
+		if len(m.RoomIDs) == 0 {
+			return rejectedSchema
+		}
+		if len(m.RoomIDs) > pubSubMaxRoomIDs {
+			return rejectedSize
+		}
+		// A withdrawal can only be for the sender's own rooms, and a want can
+		// only be for rooms of the node that is being asked.
+		owner := from
+		if m.Type == pubSubWant {
+			var err error
+			if owner, err = peer.IDB58Decode(m.Peer); err != nil {
+				return rejectedSchema
+			}
+		}
+		for _, roomID := range m.RoomIDs {
+			if reason := t.checkRoomID(roomID, owner); reason != "" {
+				return reason
+			}
+		}
+	default:
+		return rejectedSchema
+	}
+	return ""
+}
+
+// checkRoom checks that the room is well formed and belongs to the owner.
+func (t *PubSubTransport) checkRoom(room gomatrixserverlib.PublicRoom, owner peer.ID) string {
+	if reason := t.checkRoomID(room.RoomID, owner); reason != "" {
+		return reason
+	}
+	if room.JoinedMembersCount < 0 || len(room.Aliases) > pubSubMaxAliases {
+		return rejectedSchema
+	}
+	for _, field := range append([]string{
+		room.Name, room.Topic, room.CanonicalAlias, room.AvatarURL,
+	}, room.Aliases...) {
+		if len(field) > pubSubMaxFieldLength {
+			return rejectedSize
+		}
+	}
+	return ""
+}
+
+// checkRoomID checks that the room ID is well formed and that its server part
+// belongs to the owner.
+func (t *PubSubTransport) checkRoomID(roomID string, owner peer.ID) string {
+	if len(roomID) > pubSubMaxFieldLength {
+		return rejectedSize
+	}
+	_, domain, err := gomatrixserverlib.SplitID('!', roomID)
+	if err != nil {
+		return rejectedSchema
+	}
+	if !t.owns(string(domain), owner) {
+		return rejectedSpoofed
+	}
+	return ""
+}
+
+// rateLimiter counts how many messages each node has sent in the current
+// window.
+type rateLimiter struct {
+	limit   int
+	window  time.Duration
+	windows map[peer.ID]*rateWindow
+	mutex   sync.Mutex // protects windows
+}
+
+type rateWindow struct {
+	start time.Time
+	count int
+}
+
+func newRateLimiter(limit int, window time.Duration) *rateLimiter {
+	return &rateLimiter{
+		limit:   limit,
+		window:  window,
+		windows: make(map[peer.ID]*rateWindow),
+	}
+}
+
+// allow counts a message from the node, and returns whether it is within the
+// limit.
+func (r *rateLimiter) allow(p peer.ID) bool {
+	now := time.Now()
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	w, ok := r.windows[p]
+	if !ok || now.Sub(w.start) >= r.window {
+		w = &rateWindow{start: now}
+		r.windows[p] = w
+	}
+	w.count++
+	return w.count <= r.limit
+}
+
+// prune forgets about the nodes whose windows have ended.
+func (r *rateLimiter) prune() {
+	now := time.Now()
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for p, w := range r.windows {
+		if now.Sub(w.start) >= r.window {
+			delete(r.windows, p)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package directory
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/lihram/server/v2/internal/sqlutil"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const discoveredRoomsSchema = `
+-- Stores the public rooms that were announced by other nodes.
+CREATE TABLE IF NOT EXISTS p2p_discovered_rooms (
+    room_id TEXT NOT NULL PRIMARY KEY,
+    -- The node that last announced the room.
+    source TEXT NOT NULL,
+    -- The room as it was announced, as JSON.
+    room_json TEXT NOT NULL,
+    -- When we first and last heard about the room.
+    first_seen_ts BIGINT NOT NULL,
+    last_seen_ts BIGINT NOT NULL
+);
+`
+
+const upsertDiscoveredRoomSQL = "" +
+	"INSERT INTO p2p_discovered_rooms (room_id, source, room_json, first_seen_ts, last_seen_ts)" +
+	" VALUES ($1, $2, $3, $4, $5)" +
+	" ON CONFLICT (room_id) DO UPDATE SET source = $2, room_json = $3, last_seen_ts = $5"
+
+const selectDiscoveredRoomsSQL = "" +
+	"SELECT source, room_json, first_seen_ts, last_seen_ts FROM p2p_discovered_rooms"
+
+const deleteExpiredDiscoveredRoomsSQL = "" +
+	"DELETE FROM p2p_discovered_rooms WHERE last_seen_ts < $1"
+
+const deleteDiscoveredRoomSQL = "" +
+	"DELETE FROM p2p_discovered_rooms WHERE room_id = $1"
+
+// SQLDiscoveredRoomsTable is a DiscoveredRoomsTable stored in an SQLite or
+// PostgreSQL database.
+type SQLDiscoveredRoomsTable struct {
+	db                               *sql.DB
+	upsertDiscoveredRoomStmt         *sql.Stmt
+	selectDiscoveredRoomsStmt        *sql.Stmt
+	deleteExpiredDiscoveredRoomsStmt *sql.Stmt
+	deleteDiscoveredRoomStmt         *sql.Stmt
+}
+
+// NewSQLDiscoveredRoomsTable opens the database with the given driver, either
+// "sqlite3" or "postgres", and creates the table if it doesn't exist yet. The
+// driver must have been imported.
+func NewSQLDiscoveredRoomsTable(driverName, dataSourceName string) (*SQLDiscoveredRoomsTable, error) {
+	t := &SQLDiscoveredRoomsTable{}
+	var err error
+	t.db, err = sqlutil.Open(driverName, dataSourceName, discoveredRoomsSchema, []sqlutil.Statement{
+		{Stmt: &t.upsertDiscoveredRoomStmt, SQL: upsertDiscoveredRoomSQL},
+		{Stmt: &t.selectDiscoveredRoomsStmt, SQL: selectDiscoveredRoomsSQL},
+		{Stmt: &t.deleteExpiredDiscoveredRoomsStmt, SQL: deleteExpiredDiscoveredRoomsSQL},
+		{Stmt: &t.deleteDiscoveredRoomStmt, SQL: deleteDiscoveredRoomSQL},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// UpsertDiscoveredRoom implements DiscoveredRoomsTable.
+func (t *SQLDiscoveredRoomsTable) UpsertDiscoveredRoom(ctx context.Context, room DiscoveredRoom) error {
+	roomJSON, err := json.Marshal(room.Room)
+	if err != nil {
+		return err
+	}
+	_, err = t.upsertDiscoveredRoomStmt.ExecContext(
+		ctx, room.Room.RoomID, room.Source, string(roomJSON),
+		gomatrixserverlib.AsTimestamp(room.FirstSeen),
+		gomatrixserverlib.AsTimestamp(room.LastSeen),
+	)
+	return err
+}
+
+// SelectDiscoveredRooms implements DiscoveredRoomsTable.
+func (t *SQLDiscoveredRoomsTable) SelectDiscoveredRooms(ctx context.Context) ([]DiscoveredRoom, error) {
+	rows, err := t.selectDiscoveredRoomsStmt.QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close() // nolint: errcheck
+
+	var rooms []DiscoveredRoom
+	for rows.Next() {
+		var room DiscoveredRoom
+		var roomJSON string
+		var firstSeen, lastSeen gomatrixserverlib.Timestamp
+		if err = rows.Scan(&room.Source, &roomJSON, &firstSeen, &lastSeen); err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal([]byte(roomJSON), &room.Room); err != nil {
+			continue
+		}
+		room.FirstSeen = firstSeen.Time()
+		room.LastSeen = lastSeen.Time()
+		rooms = append(rooms, room)
+	}
+	return rooms, rows.Err()
+}
+
+// DeleteExpiredDiscoveredRooms implements DiscoveredRoomsTable.
+func (t *SQLDiscoveredRoomsTable) DeleteExpiredDiscoveredRooms(ctx context.Context, before time.Time) error {
+	_, err := t.deleteExpiredDiscoveredRoomsStmt.ExecContext(ctx, gomatrixserverlib.AsTimestamp(before))
+	return err
+}
+
+// DeleteDiscoveredRoom implements DiscoveredRoomsTable.
+func (t *SQLDiscoveredRoomsTable) DeleteDiscoveredRoom(ctx context.Context, roomID string) error {
+	_, err := t.deleteDiscoveredRoomStmt.ExecContext(ctx, roomID)
+	return err
+}
+
+// Close closes the database.
+func (t *SQLDiscoveredRoomsTable) Close() error {
+	return t.db.Close()
+}
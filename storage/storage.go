@@ -15,48 +15,106 @@
 package storage
 
 import (
+	"io"
 	"net/url"
+	"time"
 
-	"github.com/lihram/server/v2/storage/postgreswithdht"
-	"github.com/lihram/server/v2/storage/postgreswithpubsub"
+	"github.com/lihram/server/v2/storage/directory"
 
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
 	dht "github.com/libp2p/go-libp2p-kad-dht"
 	pubsub "github.com/libp2p/go-libp2p-pubsub"
 	"github.com/matrix-org/dendrite/publicroomsapi/storage"
+	"github.com/matrix-org/dendrite/publicroomsapi/storage/postgres"
 	"github.com/matrix-org/dendrite/publicroomsapi/storage/sqlite3"
+
+	// Import the database drivers for the table of discovered rooms.
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
 )
 
 const schemePostgres = "postgres"
 const schemeFile = "file"
 
-// NewPublicRoomsServerDatabase opens a database connection.
-func NewPublicRoomsServerDatabaseWithDHT(dataSourceName string, dht *dht.IpfsDHT) (storage.Database, error) {
-	uri, err := url.Parse(dataSourceName)
+// NewPublicRoomsServerDatabaseWithDHT opens a database connection, and shares
+// its public rooms through the DHT. The private key is used to sign the rooms
+// that we put into the DHT, and owns checks that the rooms found there belong
+// to the node that put them there. Discovered rooms are stored in the table
+// database, and kept for the TTL after they were last seen.
+func NewPublicRoomsServerDatabaseWithDHT(dataSourceName, tableDataSourceName string, dht *dht.IpfsDHT, privKey crypto.PrivKey, owns directory.ServerOwner, ttl time.Duration) (storage.Database, error) {
+	transport, err := directory.NewDHTTransport(dht, privKey)
 	if err != nil {
-		return postgreswithdht.NewPublicRoomsServerDatabase(dataSourceName, dht)
+		return nil, err
 	}
-	switch uri.Scheme {
-	case schemePostgres:
-		return postgreswithdht.NewPublicRoomsServerDatabase(dataSourceName, dht)
-	case schemeFile:
-		return sqlite3.NewPublicRoomsServerDatabase(dataSourceName)
-	default:
-		return postgreswithdht.NewPublicRoomsServerDatabase(dataSourceName, dht)
+	return newDirectoryDatabase(dataSourceName, tableDataSourceName, transport, owns, ttl)
+}
+
+// NewPublicRoomsServerDatabaseWithPubSub opens a database connection, and
+// shares its public rooms through pubsub on the given topic. Our own peer ID
+// is needed to ignore the rooms that we announce ourselves, and owns checks
+// that announced rooms belong to the node that announced them. Discovered
+// rooms are stored in the table database, and kept for the TTL after they
+// were last seen.
+func NewPublicRoomsServerDatabaseWithPubSub(dataSourceName, tableDataSourceName string, pubsub *pubsub.PubSub, self peer.ID, topic string, owns directory.ServerOwner, ttl time.Duration) (storage.Database, error) {
+	transport, err := directory.NewPubSubTransport(pubsub, self, topic, owns)
+	if err != nil {
+		return nil, err
+	}
+	return newDirectoryDatabase(dataSourceName, tableDataSourceName, transport, owns, ttl)
+}
+
+// newDirectoryDatabase opens a database connection and the table of
+// discovered rooms, and shares the public rooms through the transport. If it
+// fails, everything that it opened is closed again, as is the transport.
+func newDirectoryDatabase(dataSourceName, tableDataSourceName string, transport directory.Transport, owns directory.ServerOwner, ttl time.Duration) (_ storage.Database, err error) {
+	var closers []io.Closer
+	defer func() {
+		if err != nil {
+			for i := len(closers) - 1; i >= 0; i-- {
+				closers[i].Close() // nolint: errcheck
+			}
+		}
+	}()
+	if closer, ok := transport.(io.Closer); ok {
+		closers = append(closers, closer)
+	}
+	db, err := newPublicRoomsServerDatabase(dataSourceName)
+	if err != nil {
+		return nil, err
+	}
+	if closer, ok := db.(io.Closer); ok {
+		closers = append(closers, closer)
+	}
+	table, err := newDiscoveredRoomsTable(tableDataSourceName)
+	if err != nil {
+		return nil, err
+	}
+	closers = append(closers, table)
+	return directory.NewDatabase(db, table, transport, owns, ttl)
+}
+
+// newDiscoveredRoomsTable opens the table of discovered rooms.
+func newDiscoveredRoomsTable(dataSourceName string) (*directory.SQLDiscoveredRoomsTable, error) {
+	uri, err := url.Parse(dataSourceName)
+	if err == nil && uri.Scheme == schemeFile {
+		return directory.NewSQLDiscoveredRoomsTable("sqlite3", dataSourceName)
 	}
+	return directory.NewSQLDiscoveredRoomsTable("postgres", dataSourceName)
 }
 
-// NewPublicRoomsServerDatabase opens a database connection.
-func NewPublicRoomsServerDatabaseWithPubSub(dataSourceName string, pubsub *pubsub.PubSub) (storage.Database, error) {
+// newPublicRoomsServerDatabase opens a database connection.
+func newPublicRoomsServerDatabase(dataSourceName string) (storage.Database, error) {
 	uri, err := url.Parse(dataSourceName)
 	if err != nil {
-		return postgreswithpubsub.NewPublicRoomsServerDatabase(dataSourceName, pubsub)
+		return postgres.NewPublicRoomsServerDatabase(dataSourceName, nil)
 	}
 	switch uri.Scheme {
 	case schemePostgres:
-		return postgreswithpubsub.NewPublicRoomsServerDatabase(dataSourceName, pubsub)
+		return postgres.NewPublicRoomsServerDatabase(dataSourceName, nil)
 	case schemeFile:
 		return sqlite3.NewPublicRoomsServerDatabase(dataSourceName)
 	default:
-		return postgreswithpubsub.NewPublicRoomsServerDatabase(dataSourceName, pubsub)
+		return postgres.NewPublicRoomsServerDatabase(dataSourceName, nil)
 	}
 }